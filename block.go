@@ -0,0 +1,96 @@
+package veild
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// Ways of answering blocked queries.
+const (
+	// blockModeNXDomain answers NXDOMAIN with an SOA so it can be negatively cached.
+	blockModeNXDomain = "nxdomain"
+
+	// blockModeNoData answers with no records and an SOA.
+	blockModeNoData = "nodata"
+
+	// blockModeRefused answers REFUSED.
+	blockModeRefused = "refused"
+
+	// blockModeNull answers A queries with 0.0.0.0 and AAAA queries with ::.
+	blockModeNull = "null"
+
+	// blockModeSinkhole answers A and AAAA queries with the configured
+	// addresses, e.g. a local server with a block page.
+	blockModeSinkhole = "sinkhole"
+)
+
+// ErrInvalidBlockMode is returned for an unknown block mode, or sinkhole mode
+// without any addresses.
+var ErrInvalidBlockMode = fmt.Errorf("invalid block mode, expected one of %s, %s, %s, %s or %s (with addresses)",
+	blockModeNXDomain, blockModeNoData, blockModeRefused, blockModeNull, blockModeSinkhole)
+
+// validateBlockMode checks the configured block mode can be used.
+func validateBlockMode(mode string, addrs []netip.Addr) error {
+	switch mode {
+	case "", blockModeNXDomain, blockModeNoData, blockModeRefused, blockModeNull:
+		return nil
+	case blockModeSinkhole:
+		if len(addrs) > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidBlockMode, mode)
+}
+
+// blockResponse forms the response to a blocked query according to the
+// configured block mode.
+// SEE: https://en.wikipedia.org/wiki/DNS_sinkhole
+func blockResponse(query []byte) []byte {
+	ttl := uint32(config.BlockTTL.Seconds())
+
+	switch config.BlockMode {
+	case blockModeRefused:
+		return newResponse(query, rcodeRefused)
+	case blockModeNoData:
+		return appendSOA(setFlags(newResponse(query, rcodeSuccess), flagAA), ttl)
+	case blockModeNull, blockModeSinkhole:
+		response := setFlags(newResponse(query, rcodeSuccess), flagAA)
+
+		rType := questionType(query)
+		addrs := blockAddrs(rType)
+
+		// Nothing to answer with for this type, so it's NODATA.
+		if len(addrs) == 0 {
+			return appendSOA(response, ttl)
+		}
+
+		for _, addr := range addrs {
+			response = appendRecord(response, answerCount, rType, ttl, addr.AsSlice())
+		}
+
+		return response
+	}
+
+	return appendSOA(setFlags(newResponse(query, rcodeNXDomain), flagAA), ttl)
+}
+
+// blockAddrs returns the addresses to answer a blocked query of rType with.
+func blockAddrs(rType uint16) []netip.Addr {
+	var addrs []netip.Addr
+
+	switch config.BlockMode {
+	case blockModeNull:
+		addrs = []netip.Addr{netip.IPv4Unspecified(), netip.IPv6Unspecified()}
+	case blockModeSinkhole:
+		addrs = config.BlockAddrs
+	}
+
+	var matching []netip.Addr
+	for _, addr := range addrs {
+		if (rType == typeA && addr.Is4()) || (rType == typeAAAA && addr.Is6() && !addr.Is4In6()) {
+			matching = append(matching, addr)
+		}
+	}
+
+	return matching
+}
@@ -0,0 +1,88 @@
+package veild
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func Test_blockResponse(t *testing.T) {
+	sinkhole := []netip.Addr{netip.MustParseAddr("192.168.1.2"), netip.MustParseAddr("fd00::2")}
+
+	tests := []struct {
+		name      string
+		mode      string
+		rType     uint16
+		rcode     int
+		answers   []string
+		authority bool
+	}{
+		{name: "default", rType: typeA, rcode: rcodeNXDomain, authority: true},
+		{name: "nxdomain", mode: blockModeNXDomain, rType: typeA, rcode: rcodeNXDomain, authority: true},
+		{name: "nodata", mode: blockModeNoData, rType: typeA, rcode: rcodeSuccess, authority: true},
+		{name: "refused", mode: blockModeRefused, rType: typeA, rcode: rcodeRefused},
+		{name: "null A", mode: blockModeNull, rType: typeA, rcode: rcodeSuccess, answers: []string{"0.0.0.0"}},
+		{name: "null AAAA", mode: blockModeNull, rType: typeAAAA, rcode: rcodeSuccess, answers: []string{"::"}},
+		{name: "null MX", mode: blockModeNull, rType: 15, rcode: rcodeSuccess, authority: true},
+		{name: "sinkhole A", mode: blockModeSinkhole, rType: typeA, rcode: rcodeSuccess, answers: []string{"192.168.1.2"}},
+		{name: "sinkhole AAAA", mode: blockModeSinkhole, rType: typeAAAA, rcode: rcodeSuccess, answers: []string{"fd00::2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{BlockMode: tt.mode, BlockTTL: 5 * time.Minute, BlockAddrs: sinkhole}
+
+			response := blockResponse(newTestQuery("doubleclick.net", tt.rType))
+
+			msg, err := parseMessage(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := rcode(response); got != tt.rcode {
+				t.Errorf("wanted rcode %d got %d", tt.rcode, got)
+			}
+
+			var answers []string
+			for _, rr := range msg.answers {
+				addr, _ := netip.AddrFromSlice(response[rr.rdata : rr.rdata+rr.rdLength])
+				answers = append(answers, addr.String())
+
+				if ttl := binary.BigEndian.Uint32(response[rr.ttl:]); ttl != 300 {
+					t.Errorf("wanted answer TTL of 300 got %d", ttl)
+				}
+			}
+
+			if len(answers) != len(tt.answers) || (len(answers) > 0 && answers[0] != tt.answers[0]) {
+				t.Errorf("wanted answers %v got %v", tt.answers, answers)
+			}
+
+			if got := len(msg.authority) == 1 && msg.authority[0].rType == typeSOA; got != tt.authority {
+				t.Errorf("wanted SOA %v got %v", tt.authority, got)
+			}
+
+			// Synthesized SOAs can be negatively cached for the block TTL.
+			if tt.authority {
+				if ttl, ok := negativeTTL(response, msg); !ok || ttl != 300 {
+					t.Errorf("wanted negative TTL of 300 got %d", ttl)
+				}
+			}
+		})
+	}
+}
+
+func Test_validateBlockMode(t *testing.T) {
+	if err := validateBlockMode(blockModeSinkhole, nil); !errors.Is(err, ErrInvalidBlockMode) {
+		t.Errorf("expected sinkhole mode without addresses to be invalid, got %v", err)
+	}
+
+	if err := validateBlockMode("blackhole", nil); !errors.Is(err, ErrInvalidBlockMode) {
+		t.Errorf("expected unknown mode to be invalid, got %v", err)
+	}
+
+	if err := validateBlockMode(blockModeNull, nil); err != nil {
+		t.Errorf("expected null mode to be valid, got %v", err)
+	}
+}
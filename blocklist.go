@@ -1,66 +1,158 @@
 package veild
 
 import (
-	"bufio"
 	"log/slog"
 	"os"
-	"regexp"
+	"slices"
 	"sync"
 )
 
-// Blocklist represents a DNS blocklist.
+// Blocklist represents a DNS blocklist, made up of one or more lists merged
+// together. Entries block the domain and all of its subdomains,
+// `*.example.com` entries block only the subdomains.
+//
+// Entries matching an exception (`@@||example.com^` in adblock lists) aren't
+// blocked by the list the exception came from.
 type Blocklist struct {
-	mu   sync.Mutex
-	list map[string]struct{}
-	log  *slog.Logger
+	mu sync.Mutex
+
+	// list maps each entry to the names of the lists it came from.
+	list       *domainTrie[[]string]
+	exceptions map[string]*domainTrie[struct{}]
+	sources    map[string]BlocklistEntry
+
+	// matches counts the names matched by each list.
+	matches map[string]uint64
+
+	log *slog.Logger
 }
 
-// NewBlocklist creates a new Blocklist from a given hosts file.
-func NewBlocklist(blocklistPath string, logger *slog.Logger) (*Blocklist, error) {
+// NewBlocklist creates a new Blocklist from the given lists, see parseList for
+// the formats supported.
+func NewBlocklist(entries []BlocklistEntry, logger *slog.Logger) (*Blocklist, error) {
+	return newDomainList(entries, logger.With("module", "blocklist"))
+}
+
+// NewAllowlist creates an allowlist from a given file. It has the same
+// matching rules as a Blocklist, but matches are let through rather than blocked.
+func NewAllowlist(allowlistPath, format string, logger *slog.Logger) (*Blocklist, error) {
+	entries := []BlocklistEntry{{Name: "allowlist", Path: allowlistPath, Format: format}}
+	return newDomainList(entries, logger.With("module", "allowlist"))
+}
+
+func newDomainList(entries []BlocklistEntry, logger *slog.Logger) (*Blocklist, error) {
+	b := &Blocklist{
+		list:       &domainTrie[[]string]{},
+		exceptions: make(map[string]*domainTrie[struct{}]),
+		sources:    make(map[string]BlocklistEntry),
+		matches:    make(map[string]uint64),
+		log:        logger,
+	}
+
+	for _, entry := range entries {
+		if err := b.load(entry); err != nil {
+			return nil, err
+		}
+	}
 
-	// Parse and load the blocklist.
-	blocklist, err := parseBlocklist(blocklistPath)
+	return b, nil
+}
+
+// load parses a list and merges it in.
+func (b *Blocklist) load(entry BlocklistEntry) error {
+	f, err := os.Open(entry.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Parse and load the list.
+	list, err := parseList(f, entry.Format)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &Blocklist{
-		list: blocklist,
-		log:  logger.With("module", "blocklist"),
-	}, nil
+	report := list.report
+	b.log.Info("Parsed list", "list", entry.Name, "category", entry.Category, "path", entry.Path, "format", entry.Format,
+		"accepted", report.accepted, "exceptions", report.exceptions, "ignored", report.ignored, "invalid", report.invalid)
+
+	list.rules.walk(func(rule string) {
+		b.list.Update(rule, func(names []string) []string {
+			return append(names, entry.Name)
+		})
+	})
+
+	b.exceptions[entry.Name] = list.exceptions
+	b.sources[entry.Name] = entry
+
+	return nil
+}
+
+// replace swaps in the lists from other, keeping the match counts.
+func (b *Blocklist) replace(other *Blocklist) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.list = other.list
+	b.exceptions = other.exceptions
+	b.sources = other.sources
 }
 
 // Exists returns a boolean as to whether this entry was found or not in the list.
 func (b *Blocklist) Exists(item string) bool {
+	_, _, ok := b.Match(item)
+	return ok
+}
+
+// Match returns the most specific entry which blocks host along with all the
+// lists blocking it, if any.
+func (b *Blocklist) Match(host string) (string, []BlocklistEntry, bool) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
-	if _, ok := b.list[item]; ok {
-		return true
+
+	var rule string
+	var lists []BlocklistEntry
+
+	for _, match := range b.list.MatchAll(host) {
+		for _, name := range match.value {
+			// Skip lists with an exception for host.
+			if _, _, ok := b.exceptions[name].Match(host); ok {
+				b.log.Debug("Exception match", "host", host, "rule", match.rule, "list", name)
+				continue
+			}
+
+			rule = match.rule
+			if !slices.ContainsFunc(lists, func(e BlocklistEntry) bool { return e.Name == name }) {
+				lists = append(lists, b.sources[name])
+			}
+		}
 	}
-	return false
-}
 
-// parseBlocklist handles parsing of a hosts file.
-func parseBlocklist(blocklistPath string) (map[string]struct{}, error) {
+	if len(lists) == 0 {
+		return "", nil, false
+	}
 
-	blocklistFile, err := os.Open(blocklistPath)
-	if err != nil {
-		return nil, err
+	for _, list := range lists {
+		b.matches[list.Name]++
 	}
-	defer blocklistFile.Close()
 
-	blocklist := make(map[string]struct{})
-	pattern := regexp.MustCompile(`^[^#].+\s+([A-Za-z\-0-9\.]+)$`)
-	scanner := bufio.NewScanner(blocklistFile)
+	return rule, lists, true
+}
 
-	for scanner.Scan() {
-		text := scanner.Text()
-		match := pattern.FindStringSubmatch(text)
-		if len(match) > 1 {
-			blocklist[match[1]] = struct{}{}
-		}
+// Stats logs the number of names matched by each list.
+func (b *Blocklist) Stats() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
+	for name, matches := range b.matches {
+		b.log.Info("Stats", "list", name, "category", b.sources[name].Category, "matches", matches, "context", "stats")
 	}
+}
+
+// Len returns the number of entries in the list.
+func (b *Blocklist) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-	return blocklist, nil
+	return b.list.Len()
 }
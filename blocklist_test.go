@@ -1,12 +1,16 @@
 package veild
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
 func TestBlocklist_NewBlocklist(t *testing.T) {
 	logger := newLogger()
-	_, err := NewBlocklist("nonexistantfile.txt", logger)
+	_, err := NewBlocklist([]BlocklistEntry{{Name: "test", Path: "nonexistantfile.txt"}}, logger)
 	if err == nil {
 		t.Error("non-existence blocklist, should error")
 	}
@@ -14,9 +18,98 @@ func TestBlocklist_NewBlocklist(t *testing.T) {
 
 func TestBlocklist_Exists(t *testing.T) {
 	logger := newLogger()
-	blocklist, _ := NewBlocklist("fixtures/blocklist_test.txt", logger)
+	blocklist, _ := NewBlocklist([]BlocklistEntry{{Name: "test", Path: "fixtures/blocklist_test.txt"}}, logger)
 	blocklist.Exists("0-edge-chat.facebook.com")
 	if blocklist.Exists("protonmail.com") {
 		t.Error("exists when it shouldn't")
 	}
 }
+
+func TestBlocklist_Match(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	os.WriteFile(path, []byte("# Ads\n0.0.0.0 doubleclick.net\n*.example.com\ntracker.io\n"), 0o600)
+
+	blocklist, err := NewBlocklist([]BlocklistEntry{{Name: "test", Path: path}}, newLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if blocklist.Len() != 3 {
+		t.Errorf("wanted 3 entries got %d", blocklist.Len())
+	}
+
+	if rule, _, ok := blocklist.Match("Stats.G.DoubleClick.net."); !ok || rule != "doubleclick.net" {
+		t.Errorf("expected subdomain to be blocked by its parent, got %q", rule)
+	}
+
+	if !blocklist.Exists("www.example.com") || blocklist.Exists("example.com") {
+		t.Error("expected wildcard to only block subdomains")
+	}
+}
+
+func TestBlocklist_Match_lists(t *testing.T) {
+	blocklists, err := NewBlocklists("fixtures/test_blocklists.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocklist, err := NewBlocklist(blocklists.Blocklists, newLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host  string
+		lists []string
+	}{
+		{"malware.example", []string{"malware"}},
+		{"0-act.channel.facebook.com", []string{"malware", "social"}},
+		// The malware list has an exception for it, the social list doesn't.
+		{"0-edge-chat.facebook.com", []string{"social"}},
+		{"protonmail.com", nil},
+	}
+
+	for _, tt := range tests {
+		_, lists, _ := blocklist.Match(tt.host)
+
+		var names []string
+		for _, list := range lists {
+			names = append(names, list.Name)
+		}
+
+		if !reflect.DeepEqual(names, tt.lists) {
+			t.Errorf("%s: wanted lists %v got %v", tt.host, tt.lists, names)
+		}
+	}
+
+	if blocklist.matches["malware"] != 2 || blocklist.matches["social"] != 2 {
+		t.Errorf("expected matches to be counted per list, got %v", blocklist.matches)
+	}
+}
+
+func TestBlocklists_NewBlocklists(t *testing.T) {
+	blocklists, err := NewBlocklists("fixtures/test_blocklists.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	malware := blocklists.Blocklists[1]
+	if malware.Path != filepath.Join("fixtures", "test_malware_list.txt") || malware.label() != "malware" {
+		t.Errorf("unexpected blocklist %+v", malware)
+	}
+
+	tests := []struct {
+		filename string
+		want     error
+	}{
+		{"fixtures/nonexistent.yml", ErrReadingBlocklistsFile},
+		{"fixtures/blocklist_test.txt", ErrUnmarshallingBlocklists},
+		{"fixtures/test_invalid_blocklists.yml", ErrInvalidBlocklist},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewBlocklists(tt.filename); !errors.Is(err, tt.want) {
+			t.Errorf("%s: wanted %v got %v", tt.filename, tt.want, err)
+		}
+	}
+}
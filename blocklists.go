@@ -0,0 +1,101 @@
+package veild
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// BlocklistEntry implements a blocklist loaded from a file.
+type BlocklistEntry struct {
+	Name string
+
+	// Category is what the list blocks (ads, malware, tracking...), used in
+	// place of the name when logging blocked queries.
+	Category string
+
+	Path string
+
+	// Format is one of auto (the default), hosts, domains, adblock or dnsmasq.
+	Format string
+}
+
+// label returns how the list is referred to in logs.
+func (e BlocklistEntry) label() string {
+	if e.Category != "" {
+		return e.Category
+	}
+	return e.Name
+}
+
+// Blocklists implements a list of blocklists.
+type Blocklists struct {
+	Blocklists []BlocklistEntry
+}
+
+var (
+	ErrReadingBlocklistsFile   = errors.New("reading blocklists file")
+	ErrUnmarshallingBlocklists = errors.New("error unmarshalling blocklists file")
+	ErrInvalidBlocklist        = errors.New("invalid blocklist")
+)
+
+// NewBlocklists loads a list of blocklists from a file. Relative paths are
+// taken to be relative to the file.
+func NewBlocklists(blocklistsPath string) (*Blocklists, error) {
+	blocklists := &Blocklists{}
+
+	blocklistsList, err := os.ReadFile(blocklistsPath)
+	if err != nil {
+		return nil, errors.Join(ErrReadingBlocklistsFile, err)
+	}
+
+	if err := yaml.Unmarshal(blocklistsList, &blocklists); err != nil {
+		return nil, errors.Join(ErrUnmarshallingBlocklists, err)
+	}
+
+	for i := range blocklists.Blocklists {
+		entry := &blocklists.Blocklists[i]
+		if entry.Path != "" && !filepath.IsAbs(entry.Path) {
+			entry.Path = filepath.Join(filepath.Dir(blocklistsPath), entry.Path)
+		}
+	}
+
+	if err := validateBlocklists(blocklists.Blocklists); err != nil {
+		return nil, errors.Join(ErrInvalidBlocklist, err)
+	}
+
+	return blocklists, nil
+}
+
+// validateBlocklists checks each list has a path, a unique name (defaulting to
+// the file name) and a format we can parse.
+func validateBlocklists(entries []BlocklistEntry) error {
+	names := make(map[string]struct{}, len(entries))
+
+	for i := range entries {
+		entry := &entries[i]
+
+		if entry.Path == "" {
+			return fmt.Errorf("blocklist %d: missing path", i+1)
+		}
+
+		if entry.Name == "" {
+			entry.Name = strings.TrimSuffix(filepath.Base(entry.Path), filepath.Ext(entry.Path))
+		}
+
+		if _, ok := names[entry.Name]; ok {
+			return fmt.Errorf("%s: duplicate name", entry.Name)
+		}
+		names[entry.Name] = struct{}{}
+
+		if !validListFormat(entry.Format) {
+			return fmt.Errorf("%s: %w: %q", entry.Name, ErrUnknownListFormat, entry.Format)
+		}
+	}
+
+	return nil
+}
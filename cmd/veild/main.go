@@ -3,7 +3,9 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/netip"
 	"os"
+	"time"
 
 	"github.com/jamesduncombe/veild"
 )
@@ -13,12 +15,42 @@ var veilVersion string
 
 // Flags for setting up veil.
 var (
-	listenAddr    string
-	noCaching     bool
-	blocklistFile string
-	resolversFile string
-	logLevel      string
-	version       bool
+	listenAddr     string
+	noCaching      bool
+	cacheSize      int
+	cacheBytes     int
+	minTTL         time.Duration
+	maxTTL         time.Duration
+	maxNegTTL      time.Duration
+	rewriteTTL     bool
+	cacheFile      string
+	staleWindow    time.Duration
+	staleTimeout   time.Duration
+	prefetchHits   int
+	prefetchFrac   float64
+	prefetchRate   int
+	blocklistFile  string
+	blocklistFmt   string
+	blocklistsFile string
+	blockMode      string
+	blockTTL       time.Duration
+	blockAddrs     []netip.Addr
+	allowlistFile  string
+	allowlistFmt   string
+	recordsFile    string
+	rewritesFile   string
+	safeSearch     bool
+	resolversFile  string
+	logLevel       string
+	version        bool
+	timeout        time.Duration
+	retries        int
+	doh            bool
+	dohListenAddr  string
+	dot            bool
+	dotListenAddr  string
+	tlsCertFile    string
+	tlsKeyFile     string
 )
 
 func main() {
@@ -29,9 +61,46 @@ func main() {
 	// Flags init.
 	flag.StringVar(&listenAddr, "l", "127.0.0.1:53", "Listen on `address:port` for serving requests")
 	flag.BoolVar(&noCaching, "no-cache", false, "If specified, turn off caching")
+	flag.IntVar(&cacheSize, "cache-size", 10000, "Limit the cache to `n` entries (0 for no limit)")
+	flag.IntVar(&cacheBytes, "cache-bytes", 0, "Limit the cache to roughly `n` bytes (0 for no limit)")
+	flag.StringVar(&cacheFile, "cache-file", "", "Persist the cache to `cache_file` across restarts")
+	flag.DurationVar(&staleWindow, "stale-window", 0, "Keep expired cache entries for `duration` to serve if upstreams fail (0 to disable)")
+	flag.DurationVar(&staleTimeout, "stale-answer-timeout", 1800*time.Millisecond, "Serve stale cache entries to clients still waiting on upstream after `duration` (0 to disable)")
+	flag.IntVar(&prefetchHits, "prefetch-hits", 3, "Refresh cache entries with at least `n` hits before they expire (0 to disable)")
+	flag.Float64Var(&prefetchFrac, "prefetch-threshold", 0.1, "Refresh cache entries once within `fraction` of their original TTL")
+	flag.IntVar(&prefetchRate, "prefetch-rate", 10, "Send at most `n` prefetch requests upstream per second")
+	flag.DurationVar(&minTTL, "min-ttl", 0, "Cache answers for at least `duration`")
+	flag.DurationVar(&maxTTL, "max-ttl", 0, "Cache answers for at most `duration` (0 for no limit)")
+	flag.DurationVar(&maxNegTTL, "max-negative-ttl", time.Hour, "Cache NXDOMAIN and NODATA responses for at most `duration`")
+	flag.BoolVar(&rewriteTTL, "rewrite-ttl", false, "If specified, send clients the TTLs clamped by -min-ttl and -max-ttl")
 	flag.StringVar(&blocklistFile, "b", "", "Read `blocklist_file` and enable blocklisting Ad domains")
+	flag.StringVar(&blocklistsFile, "blocklists", "", "Read a list of blocklists from `blocklists_file` and load them")
+	flag.StringVar(&blockMode, "block-mode", "nxdomain", "Answer blocked queries with `mode` (nxdomain, nodata, refused, null, sinkhole)")
+	flag.DurationVar(&blockTTL, "block-ttl", time.Minute, "Give answers to blocked queries a TTL of `duration`")
+	flag.Func("block-ip", "Answer blocked queries with `ip` in sinkhole mode (can be given more than once)", func(s string) error {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return err
+		}
+		blockAddrs = append(blockAddrs, addr)
+		return nil
+	})
+	flag.StringVar(&allowlistFile, "a", "", "Read `allowlist_file` and never block the domains in it")
+	flag.StringVar(&blocklistFmt, "b-format", "auto", "Format of the blocklist file (auto, hosts, domains, adblock, dnsmasq)")
+	flag.StringVar(&allowlistFmt, "a-format", "auto", "Format of the allowlist file (auto, hosts, domains, adblock, dnsmasq)")
+	flag.StringVar(&recordsFile, "records", "", "Answer names in `records_file` (hosts or YAML) directly")
+	flag.StringVar(&rewritesFile, "rewrites", "", "Answer names with the records of others using the rules in `rewrites_file`")
+	flag.BoolVar(&safeSearch, "safe-search", false, "If specified, enforce safe search on search engines and restricted mode on YouTube")
 	flag.StringVar(&resolversFile, "r", "", "Read resolvers from `resolvers_file` and load them")
+	flag.DurationVar(&timeout, "timeout", 3*time.Second, "Wait `duration` for a response from upstream before retrying")
+	flag.IntVar(&retries, "retries", 2, "Retry requests that time out upstream `n` times on other resolvers")
 	flag.StringVar(&logLevel, "log-level", "info", "Set the logging level (debug, info, warn)")
+	flag.BoolVar(&doh, "doh", false, "If specified, serve DNS-over-HTTPS (requires -tls-cert and -tls-key)")
+	flag.StringVar(&dohListenAddr, "doh-listen", ":443", "Listen on `address:port` for DNS-over-HTTPS requests")
+	flag.BoolVar(&dot, "dot", false, "If specified, serve DNS-over-TLS (requires -tls-cert and -tls-key)")
+	flag.StringVar(&dotListenAddr, "dot-listen", ":853", "Listen on `address:port` for DNS-over-TLS requests")
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "Read the TLS certificate for serving encrypted clients from `cert_file`")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "Read the TLS private key for serving encrypted clients from `key_file`")
 	flag.BoolVar(&version, "version", false, "Displays the version of Veild")
 	flag.Parse()
 
@@ -40,15 +109,51 @@ func main() {
 		os.Exit(0)
 	}
 
+	config := &veild.Config{
+		ListenAddr:         listenAddr,
+		CachingEnabled:     !noCaching,
+		CacheMaxEntries:    cacheSize,
+		CacheMaxBytes:      cacheBytes,
+		MinTTL:             minTTL,
+		MaxTTL:             maxTTL,
+		MaxNegativeTTL:     maxNegTTL,
+		RewriteTTL:         rewriteTTL,
+		CacheFile:          cacheFile,
+		StaleWindow:        staleWindow,
+		StaleAnswerTimeout: staleTimeout,
+		PrefetchHits:       prefetchHits,
+		PrefetchThreshold:  prefetchFrac,
+		PrefetchRate:       prefetchRate,
+		BlocklistFile:      blocklistFile,
+		BlocklistFormat:    blocklistFmt,
+		BlocklistsFile:     blocklistsFile,
+		BlockMode:          blockMode,
+		BlockTTL:           blockTTL,
+		BlockAddrs:         blockAddrs,
+		AllowlistFile:      allowlistFile,
+		AllowlistFormat:    allowlistFmt,
+		LocalRecordsFile:   recordsFile,
+		RewritesFile:       rewritesFile,
+		SafeSearch:         safeSearch,
+		ResolversFile:      resolversFile,
+		LogLevel:           veild.ParseLogLevel(logLevel),
+		Version:            veilVersion,
+		TLSCertFile:        tlsCertFile,
+		TLSKeyFile:         tlsKeyFile,
+		UpstreamTimeout:    timeout,
+		UpstreamRetries:    retries,
+	}
+
+	if doh {
+		config.DoHListenAddr = dohListenAddr
+	}
+
+	if dot {
+		config.DoTListenAddr = dotListenAddr
+	}
+
 	// Start Veil.
-	veild.Run(&veild.Config{
-		ListenAddr:     listenAddr,
-		CachingEnabled: !noCaching,
-		BlocklistFile:  blocklistFile,
-		ResolversFile:  resolversFile,
-		LogLevel:       veild.ParseLogLevel(logLevel),
-		Version:        veilVersion,
-	})
+	veild.Run(config)
 }
 
 // usage handles the default usage instructions for the cmd.
@@ -0,0 +1,173 @@
+package veild
+
+import (
+	"encoding/binary"
+	"strings"
+)
+
+// Header flags.
+// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.1
+const (
+	flagQR uint16 = 1 << 15
+	flagAA uint16 = 1 << 10
+	flagTC uint16 = 1 << 9
+	flagRD uint16 = 1 << 8
+	flagRA uint16 = 1 << 7
+)
+
+// Response codes.
+// SEE: https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-6
+const (
+	rcodeSuccess  = 0
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeRefused  = 5
+
+	// rcodeBadVers is an extended RCODE, the upper 8 bits are carried in the OPT record.
+	rcodeBadVers = 16
+)
+
+// Resource record types and classes used when building responses.
+const (
+	typeA     uint16 = 1
+	typeNS    uint16 = 2
+	typeCNAME uint16 = 5
+	typePTR   uint16 = 12
+	typeMX    uint16 = 15
+	typeTXT   uint16 = 16
+	typeAAAA  uint16 = 28
+	typeSRV   uint16 = 33
+	typeANY   uint16 = 255
+	classIN   uint16 = 1
+)
+
+// rcode returns the (non-extended) response code from a DNS message header.
+func rcode(data []byte) int {
+	return int(data[3] & 0x0f)
+}
+
+// truncated reports whether a message has the TC flag set.
+func truncated(data []byte) bool {
+	return binary.BigEndian.Uint16(data[2:4])&flagTC != 0
+}
+
+// headerAndQuestion returns a copy of a message's header and question section
+// with the answer, authority and additional counts zeroed. The question is
+// dropped if it can't be parsed.
+func headerAndQuestion(data []byte) []byte {
+	end := DNSHeaderLength
+	if msg, err := parseMessage(data); err == nil {
+		end = msg.questionEnd
+	}
+
+	response := make([]byte, end)
+	copy(response, data)
+
+	// If we couldn't parse the question, drop it.
+	if end == DNSHeaderLength {
+		binary.BigEndian.PutUint16(response[4:6], 0)
+	}
+
+	// Zero out the answer, authority and additional counts.
+	clear(response[6:12])
+
+	return response
+}
+
+// newResponse forms a response to a query containing only the header and question
+// section with the given response code. Any OPT record is left to [Request.write].
+func newResponse(query []byte, rcode int) []byte {
+	response := headerAndQuestion(query)
+
+	// Keep the opcode and RD flag from the query.
+	flags := binary.BigEndian.Uint16(response[2:4]) & (0x7800 | flagRD)
+	flags |= flagQR | flagRA | uint16(rcode&0x0f)
+	binary.BigEndian.PutUint16(response[2:4], flags)
+
+	return response
+}
+
+// truncate reduces a response down to its header and question section and
+// sets the TC flag so the client knows to retry over TCP.
+// SEE: https://datatracker.ietf.org/doc/html/rfc2181#section-9
+func truncate(data []byte) []byte {
+	response := headerAndQuestion(data)
+
+	flags := binary.BigEndian.Uint16(response[2:4])
+	binary.BigEndian.PutUint16(response[2:4], flags|flagTC)
+
+	return response
+}
+
+// questionType returns the type of the query's question, or 0 if it hasn't got one.
+func questionType(query []byte) uint16 {
+	msg, err := parseMessage(query)
+	if err != nil || msg.questionEnd == DNSHeaderLength {
+		return 0
+	}
+	return binary.BigEndian.Uint16(query[msg.questionEnd-4 : msg.questionEnd-2])
+}
+
+// setFlags sets header flags on a message.
+func setFlags(data []byte, flags uint16) []byte {
+	binary.BigEndian.PutUint16(data[2:4], binary.BigEndian.Uint16(data[2:4])|flags)
+	return data
+}
+
+// Offsets of the section counts in the header.
+const (
+	answerCount    = 6
+	authorityCount = 8
+)
+
+// appendRecord adds a resource record for the question's name to the section
+// whose count is at countOffset. The response must have a question and no
+// records in later sections.
+func appendRecord(response []byte, countOffset int, rType uint16, ttl uint32, rdata []byte) []byte {
+	// The owner name is a pointer to the question's name.
+	return appendNamedRecord(response, countOffset, []byte{0xc0, byte(DNSHeaderLength)}, rType, ttl, rdata)
+}
+
+// appendNamedRecord adds a resource record with the given wire format owner
+// name, see appendRecord.
+func appendNamedRecord(response []byte, countOffset int, owner []byte, rType uint16, ttl uint32, rdata []byte) []byte {
+	response = append(response, owner...)
+	response = binary.BigEndian.AppendUint16(response, rType)
+	response = binary.BigEndian.AppendUint16(response, classIN)
+	response = binary.BigEndian.AppendUint32(response, ttl)
+	response = binary.BigEndian.AppendUint16(response, uint16(len(rdata)))
+	response = append(response, rdata...)
+
+	count := binary.BigEndian.Uint16(response[countOffset : countOffset+2])
+	binary.BigEndian.PutUint16(response[countOffset:countOffset+2], count+1)
+
+	return response
+}
+
+// encodeName returns a normalized domain name in wire format, uncompressed.
+// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-3.1
+func encodeName(name string) []byte {
+	var data []byte
+	if name != "" {
+		for label := range strings.SplitSeq(name, ".") {
+			data = append(data, byte(len(label)))
+			data = append(data, label...)
+		}
+	}
+	return append(data, 0x0)
+}
+
+// appendSOA adds an SOA record to the authority section of a response so that
+// it can be negatively cached for ttl seconds.
+// SEE: https://datatracker.ietf.org/doc/html/rfc2308#section-3
+func appendSOA(response []byte, ttl uint32) []byte {
+	// MNAME and RNAME are both the root, followed by SERIAL, REFRESH, RETRY,
+	// EXPIRE and MINIMUM.
+	rdata := []byte{0x0, 0x0}
+	for _, field := range []uint32{1, 3600, 600, 86400, ttl} {
+		rdata = binary.BigEndian.AppendUint32(rdata, field)
+	}
+
+	return appendRecord(response, authorityCount, typeSOA, ttl, rdata)
+}
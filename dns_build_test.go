@@ -0,0 +1,30 @@
+package veild
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+func Test_truncate(t *testing.T) {
+	data, _ := os.ReadFile("fixtures/phishing-detection.api.cx.metamask.io_a.pkt")
+
+	got := truncate(data)
+
+	if len(got) != 55 {
+		t.Errorf("wanted header and question only, got %d bytes", len(got))
+	}
+
+	if binary.BigEndian.Uint16(got[2:4])&flagTC == 0 {
+		t.Error("expected TC flag to be set")
+	}
+
+	if !bytes.Equal(got[4:12], []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}) {
+		t.Errorf("expected only the question count to remain, got %v", got[4:12])
+	}
+
+	if !bytes.Equal(got[12:], data[12:55]) {
+		t.Error("expected question to be preserved")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"strings"
 )
 
 const (
@@ -13,8 +14,39 @@ const (
 
 	// DNSHeaderLength is the length of a normal DNS request/response header (in bytes).
 	DNSHeaderLength int = 12
+
+	// maxUDPPayloadSize is the largest UDP payload we'll send back to a client,
+	// regardless of what they advertise.
+	maxUDPPayloadSize int = 4096
 )
 
+// typeOPT is the RR type of the EDNS0 OPT pseudo-record.
+// SEE: https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.1
+const typeOPT uint16 = 41
+
+// resourceRecord holds the layout of a single resource record within a DNS message.
+type resourceRecord struct {
+	offset   int // Start of the owner name.
+	rType    uint16
+	class    uint16
+	ttl      int // Offset of the TTL field.
+	rdata    int // Offset of the RDATA field.
+	rdLength int
+}
+
+// end returns the offset immediately after the resource record.
+func (r resourceRecord) end() int {
+	return r.rdata + r.rdLength
+}
+
+// message holds the layout of the sections of a DNS message.
+type message struct {
+	questionEnd int
+	answers     []resourceRecord
+	authority   []resourceRecord
+	additional  []resourceRecord
+}
+
 // RR represents a domain name and resource type.
 type RR struct {
 	hostname string
@@ -34,6 +66,12 @@ var ResourceTypes = map[uint16]string{
 	28:  "AAAA",
 	33:  "SRV",
 	37:  "CERT",
+	43:  "DS",
+	46:  "RRSIG",
+	47:  "NSEC",
+	48:  "DNSKEY",
+	50:  "NSEC3",
+	52:  "TLSA",
 	60:  "CDNSKEY",
 	64:  "SVCB",
 	65:  "HTTPS",
@@ -45,13 +83,6 @@ var ResourceTypes = map[uint16]string{
 var (
 	// ErrInvalidDNSPacket is returned when the packet doesn't look like a DNS packet.
 	ErrInvalidDNSPacket = errors.New("invalid dns packet")
-
-	// ErrInvalidRType is returned when a mapping cannot be found between
-	// the numeric representation of an RR type and it's string.
-	ErrInvalidRType = errors.New("invalid rtype")
-
-	// ErrProblemParsingOffsets is returned when a TTL offset cannot be parsed.
-	ErrProblemParsingOffsets = errors.New("problem parsing TTL offsets")
 )
 
 // NewRR returns a new RR.
@@ -62,12 +93,17 @@ func NewRR(data []byte) (*RR, error) {
 		return nil, fmt.Errorf("error creating rr: %w", err)
 	}
 
-	host := parseDomainName(nameType[:len(nameType)-2])
+	host, err := decodeName(nameType, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error creating rr: %w", err)
+	}
 	rtype := binary.BigEndian.Uint16(nameType[len(nameType)-2:])
 
+	// Types we don't have a name for are still passed on upstream.
+	// SEE: https://datatracker.ietf.org/doc/html/rfc3597#section-5
 	rType, ok := ResourceTypes[rtype]
 	if !ok {
-		return nil, ErrInvalidRType
+		rType = fmt.Sprintf("TYPE%d", rtype)
 	}
 
 	return &RR{
@@ -77,117 +113,210 @@ func NewRR(data []byte) (*RR, error) {
 	}, nil
 }
 
-// parseDomainName takes a slice of bytes and returns a parsed domain name.
-func parseDomainName(data []byte) string {
-	parts := make([]byte, 0)
-	i := 0
+// sliceNameType takes a DNS request and slices out the name + type of the request.
+// This is mainly used for the cache key when storing a request.
+func sliceNameType(packet []byte) ([]byte, error) {
+	end, err := skipName(packet, 0)
+	if err != nil || end+2 > len(packet) {
+		return []byte{}, ErrInvalidDNSPacket
+	}
+
+	// Return the name and type.
+	return packet[:end+2], nil
+}
+
+// skipName returns the offset immediately after the domain name starting at offset.
+// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.4
+func skipName(data []byte, offset int) (int, error) {
 	for {
-		if data[i] == 0x0 {
-			// End of label/name.
-			break
+		if offset >= len(data) {
+			return 0, ErrInvalidDNSPacket
 		}
-		if i != 0x0 {
-			// Append a `.`.
-			parts = append(parts, 0x2e)
+
+		l := int(data[offset])
+
+		switch {
+		case l == 0x0:
+			// End of the name.
+			return offset + 1, nil
+		case l&0xc0 == 0xc0:
+			// Pointer to another location in the packet, always the end of the name.
+			if offset+2 > len(data) {
+				return 0, ErrInvalidDNSPacket
+			}
+			return offset + 2, nil
+		case l&0xc0 != 0x0:
+			// Reserved label types.
+			return 0, ErrInvalidDNSPacket
+		default:
+			offset += l + 1
 		}
-		l := int(data[i])
-		parts = append(parts, data[i+1:i+l+1]...)
-		// Increment to next label offset.
-		i += l + 1
 	}
-	return string(parts)
 }
 
-// sliceNameType takes a DNS request and slices out the name + type of the request.
-// This is mainly used for the cache key when storing a request.
-func sliceNameType(packet []byte) ([]byte, error) {
-	// Scan for end of name (0x0).
-	if i := bytes.IndexByte(packet, 0x0); i != -1 {
-		// Return the name and type.
-		return packet[:i+3], nil
-	}
+// maxNamePointers limits how many compression pointers are followed when
+// decoding a name, so a malicious message can't loop forever.
+const maxNamePointers = 16
 
-	return []byte{}, ErrInvalidDNSPacket
-}
+// decodeName returns the domain name starting at offset, following any
+// compression pointers.
+// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.4
+func decodeName(data []byte, offset int) (string, error) {
+	var labels []string
 
-// ttlOffsets scans a DNS record and returns offsets of all the TTLs within it.
-// SEE: https://www.rfc-editor.org/rfc/rfc1035#section-3.2
-// SEE: https://cs.opensource.google/go/x/net/+/master:dns/dnsmessage/message.go;l=2105;drc=ea0c1d94f5e0c4b4c18b927e26e188ad8fadb38e
-func ttlOffsets(data []byte) ([]int, error) {
+	for pointers := 0; ; {
+		if offset >= len(data) {
+			return "", ErrInvalidDNSPacket
+		}
 
-	var ttlOffsets []int
+		l := int(data[offset])
 
-	// Get total answers etc.
-	answers := binary.BigEndian.Uint16(data[6:8])
-	authority := binary.BigEndian.Uint16(data[8:10])
+		switch {
+		case l == 0x0:
+			return strings.Join(labels, "."), nil
+		case l&0xc0 == 0xc0:
+			if offset+2 > len(data) || pointers == maxNamePointers {
+				return "", ErrInvalidDNSPacket
+			}
+			pointers++
+			offset = int(binary.BigEndian.Uint16(data[offset:offset+2]) & 0x3fff)
+		case l&0xc0 != 0x0:
+			return "", ErrInvalidDNSPacket
+		default:
+			if offset+l+1 > len(data) {
+				return "", ErrInvalidDNSPacket
+			}
+			labels = append(labels, string(data[offset+1:offset+l+1]))
+			offset += l + 1
+		}
+	}
+}
+
+// parseMessage walks a DNS message and returns the layout of its sections.
+func parseMessage(data []byte) (*message, error) {
+	if len(data) < DNSHeaderLength {
+		return nil, ErrInvalidDNSPacket
+	}
 
-	totalResourceRecords := int(answers + authority)
+	questions := int(binary.BigEndian.Uint16(data[4:6]))
+	answers := int(binary.BigEndian.Uint16(data[6:8]))
+	authority := int(binary.BigEndian.Uint16(data[8:10]))
+	additional := int(binary.BigEndian.Uint16(data[10:12]))
 
-	// Skip first 12 bytes (always the header, no TTLs).
 	offset := DNSHeaderLength
 
-	// Attempting to jump over Questions section.
+	// Jump over the question section (name, type and class).
+	for range questions {
+		var err error
+		if offset, err = skipName(data, offset); err != nil {
+			return nil, err
+		}
+		offset += 4
+		if offset > len(data) {
+			return nil, ErrInvalidDNSPacket
+		}
+	}
 
-	// Quickly run through the query (single one).
-	i := bytes.IndexByte(data[offset:], 0x0)
-	i += 5 // jump 1 + 4 more bytes (End of Name, Type and Class).
-	offset += i
+	msg := &message{questionEnd: offset}
 
-	// Parsing Answers and Authority RRs.
-	for range totalResourceRecords {
+	sections := []struct {
+		count   int
+		records *[]resourceRecord
+	}{
+		{answers, &msg.answers},
+		{authority, &msg.authority},
+		{additional, &msg.additional},
+	}
 
-		// Check we're not overrunning the length of the message.
-		if len(data) < offset+1 {
-			return nil, ErrProblemParsingOffsets
+	for _, section := range sections {
+		for range section.count {
+			rr, err := parseResourceRecord(data, offset)
+			if err != nil {
+				return nil, err
+			}
+			*section.records = append(*section.records, rr)
+			offset = rr.end()
 		}
+	}
 
-		// Can be:
-		// SEE: https://www.rfc-editor.org/rfc/rfc1035
-		// - a sequence of labels ending in a zero octet
-		// - a pointer (0xc0, followed by a two-octet offset)
-		// - a sequence of labels ending with a pointer
-
-	ResourceName:
-		for {
-
-			switch {
-			case data[offset]&0xc0 == 0xc0:
-				// Pointer to another location in the packet.
-				// The next byte is the offset.
-				offset += 2 // Skip the pointer.
-
-				// Peek at the next byte to see if it's a null byte.
-				// If it is then we can break out of the loop.
-				if data[offset] == 0x0 {
-					break ResourceName
-				}
-
-			case data[offset] == 0x0:
-				// End of the name.
-				offset++
-				break ResourceName
-
-			default:
-				// Advance and continue checking, this might not be the end.
-				offset++
-			}
+	return msg, nil
+}
 
-		}
+// parseResourceRecord parses the fixed fields of the resource record starting at offset.
+// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-4.1.3
+func parseResourceRecord(data []byte, offset int) (resourceRecord, error) {
+	nameEnd, err := skipName(data, offset)
+	if err != nil {
+		return resourceRecord{}, err
+	}
 
-		// Advance past the TYPE and CLASS fields.
-		offset += 4
+	// TYPE, CLASS, TTL and RDLENGTH.
+	if nameEnd+10 > len(data) {
+		return resourceRecord{}, ErrInvalidDNSPacket
+	}
 
-		// TTL field.
-		ttlOffsets = append(ttlOffsets, offset)
-		offset += 4
+	rr := resourceRecord{
+		offset:   offset,
+		rType:    binary.BigEndian.Uint16(data[nameEnd : nameEnd+2]),
+		class:    binary.BigEndian.Uint16(data[nameEnd+2 : nameEnd+4]),
+		ttl:      nameEnd + 4,
+		rdata:    nameEnd + 10,
+		rdLength: int(binary.BigEndian.Uint16(data[nameEnd+8 : nameEnd+10])),
+	}
+
+	if rr.end() > len(data) {
+		return resourceRecord{}, ErrInvalidDNSPacket
+	}
 
-		// RDLENGTH field.
-		rdLength := binary.BigEndian.Uint16(data[offset : offset+2])
-		offset += 2
+	return rr, nil
+}
+
+// udpPayloadSize returns the UDP payload size a client can accept. Without an
+// OPT record this is 512 bytes, otherwise it's the size advertised in the OPT
+// record, capped to maxUDPPayloadSize.
+// SEE: https://datatracker.ietf.org/doc/html/rfc6891#section-6.2.5
+func udpPayloadSize(data []byte) int {
+	edns, err := parseEDNS(data)
+	if err != nil || edns == nil {
+		return DNSPacketLength
+	}
+
+	return min(max(int(edns.udpSize), DNSPacketLength), maxUDPPayloadSize)
+}
+
+// questionMatches checks that a response is for the same question as a query.
+// Names are compared case-insensitively as resolvers may change the case.
+func questionMatches(query, response []byte) bool {
+	queryMsg, err := parseMessage(query)
+	if err != nil {
+		return false
+	}
+
+	responseMsg, err := parseMessage(response)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(query[4:6], response[4:6]) &&
+		bytes.EqualFold(query[DNSHeaderLength:queryMsg.questionEnd], response[DNSHeaderLength:responseMsg.questionEnd])
+}
+
+// minTTL returns the smallest TTL in the answer and authority sections.
+func minTTL(data []byte) (uint32, bool) {
+	msg, err := parseMessage(data)
+	if err != nil {
+		return 0, false
+	}
+
+	records := append(msg.answers, msg.authority...)
+	if len(records) == 0 {
+		return 0, false
+	}
 
-		// Advance past the RDATA field using RDLENGTH.
-		offset += int(rdLength)
+	ttl := binary.BigEndian.Uint32(data[records[0].ttl:])
+	for _, rr := range records[1:] {
+		ttl = min(ttl, binary.BigEndian.Uint32(data[rr.ttl:]))
 	}
 
-	return ttlOffsets, nil
+	return ttl, true
 }
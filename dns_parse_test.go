@@ -1,6 +1,7 @@
 package veild
 
 import (
+	"errors"
 	"os"
 	"reflect"
 	"slices"
@@ -27,6 +28,23 @@ func Test_NewRR(t *testing.T) {
 	}
 }
 
+func Test_NewRR_unknownType(t *testing.T) {
+	// Query for protonmail.com NAPTR record.
+	packet := slices.Concat(
+		protonMail,
+		[]byte{0x00, 0x23},
+	)
+
+	rr, err := NewRR(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.rType != "TYPE35" {
+		t.Errorf("wanted rtype TYPE35 got %s", rr.rType)
+	}
+}
+
 func Test_sliceNameType(t *testing.T) {
 	packet := slices.Concat(
 		protonMail,
@@ -53,25 +71,33 @@ func Test_sliceNameType(t *testing.T) {
 
 }
 
-func Test_parseDomainName(t *testing.T) {
-	packetBytes := protonMail
+func Test_NewRR_malformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+	}{
+		{"empty", nil},
+		{"label past the end", []byte{0x3f, 'a', 0x0, 0x0, 0x1}},
+		{"missing type", protonMail},
+		{"pointer out of range", []byte{0xc0, 0xff, 0x0, 0x1}},
+	}
 
-	want := "protonmail.com"
-	got := parseDomainName(packetBytes)
-	if got != want {
-		t.Errorf("%s should equal %s", got, want)
+	for _, tt := range tests {
+		if _, err := NewRR(tt.packet); !errors.Is(err, ErrInvalidDNSPacket) {
+			t.Errorf("%s: wanted %v got %v", tt.name, ErrInvalidDNSPacket, err)
+		}
 	}
 }
 
-func Benchmark_parseDomainName(b *testing.B) {
+func Benchmark_decodeName(b *testing.B) {
 	packetBytes := protonMail
 
 	for n := 0; n < b.N; n++ {
-		parseDomainName(packetBytes)
+		decodeName(packetBytes, 0)
 	}
 }
 
-func TestQueryCache_ttlOffsets(t *testing.T) {
+func Test_parseMessage_ttlOffsets(t *testing.T) {
 
 	tests := []struct {
 		filename string
@@ -87,16 +113,99 @@ func TestQueryCache_ttlOffsets(t *testing.T) {
 		},
 	}
 
-	for i, test := range tests {
+	for _, test := range tests {
 		data, _ := os.ReadFile(test.filename)
-		got, _ := ttlOffsets(data)
 
-		if len(got) != len(test.want) {
-			t.Errorf("wanted %d length got %d", len(got), len(test.want))
-			break
+		if got := recordTTLOffsets(data); !slices.Equal(got, test.want) {
+			t.Errorf("%s: wanted offsets %v got %v", test.filename, test.want, got)
 		}
-		if got[i] != test.want[i] {
-			t.Errorf("wanted %d offset got %d", got[i], test.want[i])
+	}
+}
+
+func Test_parseMessage(t *testing.T) {
+	data, _ := os.ReadFile("fixtures/phishing-detection.api.cx.metamask.io_a.pkt")
+
+	msg, err := parseMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.questionEnd != 55 {
+		t.Errorf("wanted question end 55 got %d", msg.questionEnd)
+	}
+
+	if len(msg.answers) != 7 || len(msg.authority) != 0 || len(msg.additional) != 1 {
+		t.Errorf("unexpected section lengths %d, %d, %d", len(msg.answers), len(msg.authority), len(msg.additional))
+	}
+
+	if msg.additional[0].rType != typeOPT {
+		t.Errorf("wanted OPT record in additional section got %d", msg.additional[0].rType)
+	}
+
+	if _, err := parseMessage(data[:100]); err != ErrInvalidDNSPacket {
+		t.Errorf("expected error parsing short packet got %v", err)
+	}
+}
+
+func Test_udpPayloadSize(t *testing.T) {
+	withOPT, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+
+	// Same request with the OPT record removed.
+	withoutOPT := slices.Clone(withOPT[:32])
+	withoutOPT[11] = 0x0
+
+	tests := []struct {
+		name string
+		data []byte
+		want int
+	}{
+		{"with OPT record", withOPT, 4096},
+		{"without OPT record", withoutOPT, 512},
+		{"malformed", []byte{0x1}, 512},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := udpPayloadSize(test.data); got != test.want {
+				t.Errorf("wanted %d got %d", test.want, got)
+			}
+		})
+	}
+}
+
+func Test_minTTL(t *testing.T) {
+	data, _ := os.ReadFile("fixtures/phishing-detection.api.cx.metamask.io_a.pkt")
+
+	got, ok := minTTL(data)
+	if !ok || got != 14 {
+		t.Errorf("wanted 14 got %d", got)
+	}
+
+	query, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+	if _, ok := minTTL(query); ok {
+		t.Error("expected no TTLs in a query")
+	}
+}
+
+func Test_decodeName(t *testing.T) {
+	// protonmail.com at 0, mail.protonmail.com at 16 and a pointer to itself at 23.
+	data := slices.Concat(protonMail, []byte{0x4, 'm', 'a', 'i', 'l', 0xc0, 0x0}, []byte{0xc0, 23})
+
+	tests := []struct {
+		offset int
+		want   string
+		err    error
+	}{
+		{0, "protonmail.com", nil},
+		{16, "mail.protonmail.com", nil},
+		{23, "", ErrInvalidDNSPacket},
+		{len(data), "", ErrInvalidDNSPacket},
+	}
+
+	for _, tt := range tests {
+		got, err := decodeName(data, tt.offset)
+		if got != tt.want || err != tt.err {
+			t.Errorf("offset %d: wanted %q (%v) got %q (%v)", tt.offset, tt.want, tt.err, got, err)
 		}
 	}
 }
@@ -0,0 +1,113 @@
+package veild
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+const (
+	// dohPath is the path DoH queries are served on.
+	// SEE: https://datatracker.ietf.org/doc/html/rfc8484#section-4.1
+	dohPath = "/dns-query"
+
+	// dohResponseTimeout is how long a DoH client waits on a response
+	// before we give up on it.
+	dohResponseTimeout = 10 * time.Second
+)
+
+// serveDoH serves DNS-over-HTTPS queries on the given listener.
+func serveDoH(ln net.Listener, tlsConfig *tls.Config, p *Pool, mainLog *slog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle(dohPath, &dohHandler{pool: p, log: mainLog})
+
+	srv := &http.Server{
+		Handler:           mux,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 5 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	// ServeTLS takes care of enabling HTTP/2.
+	if err := srv.ServeTLS(ln, "", ""); err != nil {
+		mainLog.Error("DoH server stopped", "err", err)
+	}
+}
+
+// dohHandler handles DoH queries, passing them through the same resolve
+// path as any other request.
+type dohHandler struct {
+	pool *Pool
+	log  *slog.Logger
+}
+
+// ServeHTTP handles both GET and POST DoH queries.
+// SEE: https://datatracker.ietf.org/doc/html/rfc8484#section-4.1
+func (h *dohHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var query []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		query, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = io.ReadAll(io.LimitReader(r.Body, int64(maxMessageLength)))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil || len(query) < DNSHeaderLength {
+		http.Error(w, "invalid dns query", http.StatusBadRequest)
+		return
+	}
+
+	var clientAddr net.Addr
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		clientAddr = net.TCPAddrFromAddrPort(addrPort)
+	}
+
+	responses := make(chanConn, 1)
+
+	request := &Request{
+		clientAddr: clientAddr,
+		clientConn: responses,
+		data:       query,
+		start:      time.Now(),
+		maxSize:    maxMessageLength}
+
+	numRequests.Add(1)
+
+	h.log.Info("Requests", "requests", numRequests.Load(), "context", "stats")
+
+	go resolve(h.pool, request, h.log)
+
+	select {
+	case response := <-responses:
+		w.Header().Set("Content-Type", dohContentType)
+
+		// Responses shouldn't be cached for longer than their smallest TTL.
+		// SEE: https://datatracker.ietf.org/doc/html/rfc8484#section-5.1
+		if ttl, ok := minTTL(response); ok {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+		}
+
+		w.Write(response)
+
+	case <-time.After(dohResponseTimeout):
+		http.Error(w, "upstream timeout", http.StatusGatewayTimeout)
+
+	case <-r.Context().Done():
+	}
+}
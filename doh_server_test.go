@@ -0,0 +1,131 @@
+package veild
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestQuery builds a query for host and rType with an OPT record.
+func newTestQuery(host string, rType uint16) []byte {
+	query := []byte{0xab, 0xcd, 0x01, 0x00, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x1}
+
+	for label := range strings.SplitSeq(host, ".") {
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0x0)
+	query = binary.BigEndian.AppendUint16(query, rType)
+	query = binary.BigEndian.AppendUint16(query, 1)
+
+	return append(query, (&EDNS{udpSize: 1232}).pack()...)
+}
+
+// setupTestBlocklist enables the blocklist fixture so that requests for
+// blocked hosts are answered without needing an upstream.
+func setupTestBlocklist(t *testing.T) {
+	t.Helper()
+
+	var err error
+	config = &Config{BlocklistEnabled: true}
+	blocklist, err = NewBlocklist([]BlocklistEntry{{Name: "test", Path: "fixtures/blocklist_test.txt"}}, newLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestDoHHandler(t *testing.T) *dohHandler {
+	t.Helper()
+
+	setupTestBlocklist(t)
+
+	logger := newLogger()
+	return &dohHandler{pool: NewPool(logger), log: logger}
+}
+
+func TestDoHHandler_ServeHTTP(t *testing.T) {
+	handler := newTestDoHHandler(t)
+	query := newTestQuery("0-edge-chat.facebook.com", 1)
+
+	tests := []struct {
+		name string
+		req  *http.Request
+	}{
+		{
+			name: "GET",
+			req:  httptest.NewRequest(http.MethodGet, dohPath+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil),
+		},
+		{
+			name: "POST",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodPost, dohPath, bytes.NewReader(query))
+				r.Header.Set("Content-Type", dohContentType)
+				return r
+			}(),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, test.req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("wanted status 200 got %d", w.Code)
+			}
+
+			if got := w.Header().Get("Content-Type"); got != dohContentType {
+				t.Errorf("wanted content type %s got %s", dohContentType, got)
+			}
+
+			response := w.Body.Bytes()
+			if !bytes.Equal(response[:2], query[:2]) {
+				t.Errorf("expected ID to match query, got %v", response[:2])
+			}
+			if rcode(response) != rcodeNXDomain {
+				t.Errorf("wanted NXDOMAIN got rcode %d", rcode(response))
+			}
+		})
+	}
+}
+
+func TestDoHHandler_ServeHTTP_errors(t *testing.T) {
+	handler := newTestDoHHandler(t)
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{
+			name: "bad encoding",
+			req:  httptest.NewRequest(http.MethodGet, dohPath+"?dns=!!!", nil),
+			want: http.StatusBadRequest,
+		},
+		{
+			name: "wrong content type",
+			req:  httptest.NewRequest(http.MethodPost, dohPath, strings.NewReader("query")),
+			want: http.StatusUnsupportedMediaType,
+		},
+		{
+			name: "wrong method",
+			req:  httptest.NewRequest(http.MethodPut, dohPath, nil),
+			want: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, test.req)
+
+			if w.Code != test.want {
+				t.Errorf("wanted status %d got %d", test.want, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package veild
+
+import (
+	"strings"
+)
+
+// domainTrie matches domain names against a set of rules, stored by their
+// labels in reverse order so a lookup only walks as deep as the name.
+//
+// A rule of `example.com` matches the domain and all of its subdomains, a rule
+// of `*.example.com` matches only its subdomains. Matching is case-insensitive
+// and ignores any trailing dot.
+type domainTrie[T any] struct {
+	root trieNode[T]
+	size int
+}
+
+type trieNode[T any] struct {
+	children map[string]*trieNode[T]
+
+	// Rules ending at this node, for the domain and for subdomains only.
+	domain   *trieRule[T]
+	wildcard *trieRule[T]
+}
+
+// trieRule is a rule as it was added along with its value.
+type trieRule[T any] struct {
+	rule  string
+	value T
+}
+
+// normalizeDomain lowercases a domain and strips the trailing dot.
+func normalizeDomain(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// validDomain checks a normalized domain is made up of valid labels.
+func validDomain(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+
+	for label := range strings.SplitSeq(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// Insert adds a rule to the trie, replacing the value of an existing rule.
+// Returns false if the rule isn't a valid domain.
+func (t *domainTrie[T]) Insert(rule string, value T) bool {
+	return t.Update(rule, func(T) T { return value })
+}
+
+// Update adds a rule to the trie with the value returned by update, which is
+// given the existing value of the rule (or the zero value if it's new).
+// Returns false if the rule isn't a valid domain.
+func (t *domainTrie[T]) Update(rule string, update func(T) T) bool {
+	name := normalizeDomain(rule)
+
+	wildcard := strings.HasPrefix(name, "*.")
+	if wildcard {
+		name = name[2:]
+	}
+
+	if !validDomain(name) {
+		return false
+	}
+
+	node := &t.root
+	labels := strings.Split(name, ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		if node.children == nil {
+			node.children = make(map[string]*trieNode[T])
+		}
+
+		child, ok := node.children[labels[i]]
+		if !ok {
+			child = &trieNode[T]{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	entry := &node.domain
+	if wildcard {
+		entry = &node.wildcard
+	}
+
+	if *entry == nil {
+		*entry = &trieRule[T]{rule: rule}
+		t.size++
+	}
+	(*entry).value = update((*entry).value)
+
+	return true
+}
+
+// Match finds the most specific rule matching name.
+func (t *domainTrie[T]) Match(name string) (string, T, bool) {
+	matches := t.MatchAll(name)
+	if len(matches) == 0 {
+		var zero T
+		return "", zero, false
+	}
+
+	match := matches[len(matches)-1]
+	return match.rule, match.value, true
+}
+
+// MatchAll finds all the rules matching name, least specific first.
+func (t *domainTrie[T]) MatchAll(name string) []*trieRule[T] {
+	var matches []*trieRule[T]
+
+	node := &t.root
+	labels := strings.Split(normalizeDomain(name), ".")
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			break
+		}
+		node = child
+
+		if node.domain != nil {
+			matches = append(matches, node.domain)
+		}
+
+		// Wildcards only match if there are labels left.
+		if i > 0 && node.wildcard != nil {
+			matches = append(matches, node.wildcard)
+		}
+	}
+
+	return matches
+}
+
+// walk calls fn with each rule in the trie.
+func (t *domainTrie[T]) walk(fn func(rule string)) {
+	var visit func(node *trieNode[T])
+	visit = func(node *trieNode[T]) {
+		for _, entry := range []*trieRule[T]{node.domain, node.wildcard} {
+			if entry != nil {
+				fn(entry.rule)
+			}
+		}
+		for _, child := range node.children {
+			visit(child)
+		}
+	}
+	visit(&t.root)
+}
+
+// Len returns the number of rules in the trie.
+func (t *domainTrie[T]) Len() int {
+	return t.size
+}
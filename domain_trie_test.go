@@ -0,0 +1,63 @@
+package veild
+
+import (
+	"testing"
+)
+
+func TestDomainTrie_Match(t *testing.T) {
+	trie := &domainTrie[int]{}
+	for i, rule := range []string{"doubleclick.net", "*.example.com", "Tracker.IO.", "ads.example.com"} {
+		if !trie.Insert(rule, i) {
+			t.Fatalf("failed to insert %q", rule)
+		}
+	}
+
+	tests := []struct {
+		name string
+		rule string
+		ok   bool
+	}{
+		{"doubleclick.net", "doubleclick.net", true},
+		{"ad.doubleclick.net", "doubleclick.net", true},
+		{"stats.g.doubleclick.net", "doubleclick.net", true},
+		{"notdoubleclick.net", "", false},
+		{"example.com", "", false},
+		{"www.example.com", "*.example.com", true},
+		{"a.ads.example.com", "ads.example.com", true},
+		{"TRACKER.io", "Tracker.IO.", true},
+		{"cdn.tracker.io.", "Tracker.IO.", true},
+		{"protonmail.com", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, _, ok := trie.Match(tt.name)
+			if ok != tt.ok || rule != tt.rule {
+				t.Errorf("wanted %q, %v got %q, %v", tt.rule, tt.ok, rule, ok)
+			}
+		})
+	}
+
+	if trie.Len() != 4 {
+		t.Errorf("wanted 4 rules got %d", trie.Len())
+	}
+}
+
+func TestDomainTrie_Insert(t *testing.T) {
+	trie := &domainTrie[int]{}
+
+	for _, rule := range []string{"", ".", "example..com", "*."} {
+		if trie.Insert(rule, 0) {
+			t.Errorf("expected %q to be rejected", rule)
+		}
+	}
+
+	// Replacing a rule doesn't add another.
+	trie.Insert("example.com", 1)
+	trie.Insert("EXAMPLE.com", 2)
+
+	if _, value, _ := trie.Match("example.com"); value != 2 || trie.Len() != 1 {
+		t.Errorf("expected rule to be replaced, got value %d and %d rules", value, trie.Len())
+	}
+}
@@ -0,0 +1,167 @@
+package veild
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+)
+
+const (
+	// ednsUDPSize is the UDP payload size veild advertises to clients and upstreams.
+	// SEE: https://www.dnsflagday.net/2020/
+	ednsUDPSize uint16 = 1232
+
+	// ednsFlagDO is the DNSSEC OK bit within the OPT record's TTL field.
+	// SEE: https://datatracker.ietf.org/doc/html/rfc3225#section-3
+	ednsFlagDO uint32 = 1 << 15
+)
+
+// EDNS option codes.
+// SEE: https://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml#dns-parameters-11
+const (
+	ednsOptionCookie  uint16 = 10
+	ednsOptionPadding uint16 = 12
+)
+
+// Errors in the EDNS parse phase.
+var (
+	// ErrInvalidOPT is returned when an OPT record is malformed or more than one is present.
+	ErrInvalidOPT = errors.New("invalid opt record")
+)
+
+// EDNS represents an EDNS0 OPT pseudo-record.
+// SEE: https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.2
+type EDNS struct {
+	udpSize  uint16
+	extRCode uint8
+	version  uint8
+	do       bool
+	options  []EDNSOption
+}
+
+// EDNSOption represents a single option within an OPT record.
+type EDNSOption struct {
+	code uint16
+	data []byte
+}
+
+// parseEDNS parses the OPT record from the additional section of a DNS message.
+// If the message has no OPT record then nil is returned.
+func parseEDNS(data []byte) (*EDNS, error) {
+	msg, err := parseMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var edns *EDNS
+
+	for _, rr := range msg.additional {
+		if rr.rType != typeOPT {
+			continue
+		}
+
+		// There must only be one OPT record and it must be owned by the root.
+		if edns != nil || data[rr.offset] != 0x0 {
+			return nil, ErrInvalidOPT
+		}
+
+		ttl := binary.BigEndian.Uint32(data[rr.ttl : rr.ttl+4])
+
+		edns = &EDNS{
+			udpSize:  rr.class,
+			extRCode: uint8(ttl >> 24),
+			version:  uint8(ttl >> 16),
+			do:       ttl&ednsFlagDO != 0,
+		}
+
+		// Options are a sequence of {code, length, data}.
+		rdata := data[rr.rdata:rr.end()]
+		for len(rdata) > 0 {
+			if len(rdata) < 4 {
+				return nil, ErrInvalidOPT
+			}
+
+			code := binary.BigEndian.Uint16(rdata[0:2])
+			length := int(binary.BigEndian.Uint16(rdata[2:4]))
+
+			if len(rdata) < 4+length {
+				return nil, ErrInvalidOPT
+			}
+
+			edns.options = append(edns.options, EDNSOption{
+				code: code,
+				data: slices.Clone(rdata[4 : 4+length]),
+			})
+			rdata = rdata[4+length:]
+		}
+	}
+
+	return edns, nil
+}
+
+// withoutOptions returns a copy of the options with any of the given codes removed.
+func (e *EDNS) withoutOptions(codes ...uint16) []EDNSOption {
+	return slices.DeleteFunc(slices.Clone(e.options), func(option EDNSOption) bool {
+		return slices.Contains(codes, option.code)
+	})
+}
+
+// pack returns the wire format of the OPT record.
+func (e *EDNS) pack() []byte {
+	ttl := uint32(e.extRCode)<<24 | uint32(e.version)<<16
+	if e.do {
+		ttl |= ednsFlagDO
+	}
+
+	rdata := []byte{}
+	for _, option := range e.options {
+		rdata = binary.BigEndian.AppendUint16(rdata, option.code)
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(option.data)))
+		rdata = append(rdata, option.data...)
+	}
+
+	// Root name followed by TYPE, CLASS (UDP size), TTL and RDLENGTH.
+	record := []byte{0x0}
+	record = binary.BigEndian.AppendUint16(record, typeOPT)
+	record = binary.BigEndian.AppendUint16(record, e.udpSize)
+	record = binary.BigEndian.AppendUint32(record, ttl)
+	record = binary.BigEndian.AppendUint16(record, uint16(len(rdata)))
+
+	return append(record, rdata...)
+}
+
+// setEDNS returns a copy of a DNS message with any existing OPT record replaced by
+// edns. If edns is nil then the OPT record is removed. Messages which can't be
+// parsed are returned as is.
+func setEDNS(data []byte, edns *EDNS) []byte {
+	msg, err := parseMessage(data)
+	if err != nil {
+		return data
+	}
+
+	additionalStart := len(data)
+	if len(msg.additional) > 0 {
+		additionalStart = msg.additional[0].offset
+	}
+
+	out := slices.Clone(data[:additionalStart])
+	additional := 0
+
+	// Keep everything in the additional section apart from OPT records.
+	for _, rr := range msg.additional {
+		if rr.rType == typeOPT {
+			continue
+		}
+		out = append(out, data[rr.offset:rr.end()]...)
+		additional++
+	}
+
+	if edns != nil {
+		out = append(out, edns.pack()...)
+		additional++
+	}
+
+	binary.BigEndian.PutUint16(out[10:12], uint16(additional))
+
+	return out
+}
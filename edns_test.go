@@ -0,0 +1,103 @@
+package veild
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_parseEDNS(t *testing.T) {
+	data, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+
+	got, err := parseEDNS(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &EDNS{udpSize: 4096}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %+v got %+v", want, got)
+	}
+
+	// Same request without the OPT record.
+	withoutOPT := setEDNS(data, nil)
+	if got, _ := parseEDNS(withoutOPT); got != nil {
+		t.Errorf("expected no OPT record got %+v", got)
+	}
+}
+
+func Test_parseEDNS_invalid(t *testing.T) {
+	data, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+
+	// Append a second OPT record.
+	twoOPTs := append(bytes.Clone(data), (&EDNS{udpSize: 512}).pack()...)
+	binary.BigEndian.PutUint16(twoOPTs[10:12], 2)
+
+	if _, err := parseEDNS(twoOPTs); err != ErrInvalidOPT {
+		t.Errorf("expected %v got %v", ErrInvalidOPT, err)
+	}
+}
+
+func TestEDNS_pack(t *testing.T) {
+	data, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+
+	want := &EDNS{
+		udpSize:  1232,
+		extRCode: 1,
+		do:       true,
+		options: []EDNSOption{
+			{code: ednsOptionCookie, data: []byte{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8}},
+			{code: ednsOptionPadding, data: []byte{0x0, 0x0}},
+		},
+	}
+
+	got, err := parseEDNS(setEDNS(data, want))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %+v got %+v", want, got)
+	}
+}
+
+func TestEDNS_withoutOptions(t *testing.T) {
+	edns := &EDNS{
+		options: []EDNSOption{
+			{code: ednsOptionCookie},
+			{code: 15},
+		},
+	}
+
+	got := edns.withoutOptions(ednsOptionCookie)
+	want := []EDNSOption{{code: 15}}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %+v got %+v", want, got)
+	}
+
+	if len(edns.options) != 2 {
+		t.Error("expected original options to be left alone")
+	}
+}
+
+func Test_setEDNS(t *testing.T) {
+	data, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+
+	stripped := setEDNS(data, nil)
+	if !bytes.Equal(stripped, append(data[:10:10], append([]byte{0x0, 0x0}, data[12:32]...)...)) {
+		t.Errorf("expected OPT record to be removed, got %v", stripped)
+	}
+
+	replaced := setEDNS(data, &EDNS{udpSize: 1232, do: true})
+	if binary.BigEndian.Uint16(replaced[10:12]) != 1 {
+		t.Error("expected a single additional record")
+	}
+
+	edns, _ := parseEDNS(replaced)
+	if edns.udpSize != 1232 || !edns.do {
+		t.Errorf("expected OPT record to be replaced, got %+v", edns)
+	}
+}
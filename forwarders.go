@@ -0,0 +1,103 @@
+package veild
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// Forwarders routes queries for the domains of each forwarder to its own pool
+// of resolvers, see ForwarderEntry.
+type Forwarders struct {
+	mu sync.Mutex
+
+	// rules maps each forwarded domain to its forwarder, pools holds the pool
+	// of each forwarder by name.
+	rules *domainTrie[*forwarder]
+	pools map[string]*Pool
+
+	log *slog.Logger
+
+	// poolLog is the logger each forwarder's pool is created with.
+	poolLog *slog.Logger
+}
+
+// forwarder is a configured forwarder and its pool.
+type forwarder struct {
+	name string
+	pool *Pool
+}
+
+// NewForwarders creates an empty set of forwarders, add to it with Reconcile.
+func NewForwarders(logger *slog.Logger) *Forwarders {
+	return &Forwarders{
+		rules:   &domainTrie[*forwarder]{},
+		pools:   make(map[string]*Pool),
+		log:     logger.With("module", "forwarders"),
+		poolLog: logger,
+	}
+}
+
+// Route returns the pool of the most specific forwarder matching host, or
+// fallback if none match.
+func (f *Forwarders) Route(host string, fallback *Pool) *Pool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	rule, fwd, ok := f.rules.Match(host)
+	if !ok {
+		return fallback
+	}
+
+	f.log.Debug("Forwarding request", "host", host, "rule", rule, "forwarder", fwd.name)
+	return fwd.pool
+}
+
+// Reconcile brings the forwarders in line with entries. Forwarders are
+// matched up by name, the resolvers of existing ones are reconciled with
+// their pools and the pools of removed ones are drained.
+func (f *Forwarders) Reconcile(entries []ForwarderEntry, newDialer func(ResolverEntry) ResolverDialer) {
+	rules := &domainTrie[*forwarder]{}
+	pools := make(map[string]*Pool, len(entries))
+
+	f.mu.Lock()
+	current := f.pools
+	f.mu.Unlock()
+
+	for _, entry := range entries {
+		pool, ok := current[entry.Name]
+		if !ok {
+			f.log.Info("Adding forwarder", "forwarder", entry.Name, "domains", entry.Domains)
+			pool = NewPool(f.poolLog.With("forwarder", entry.Name))
+			go pool.ConnectionManagement()
+		}
+
+		added, removed, kept := pool.Reconcile(entry.Resolvers, newDialer)
+		f.log.Debug("Reconciled forwarder", "forwarder", entry.Name, "added", added, "removed", removed, "kept", kept)
+
+		fwd := &forwarder{name: entry.Name, pool: pool}
+		for _, domain := range entry.Domains {
+			rules.Insert(domain, fwd)
+		}
+		pools[entry.Name] = pool
+	}
+
+	for name, pool := range current {
+		if _, ok := pools[name]; !ok {
+			f.log.Info("Removing forwarder", "forwarder", name)
+			pool.Reconcile(nil, newDialer)
+		}
+	}
+
+	f.mu.Lock()
+	f.rules = rules
+	f.pools = pools
+	f.mu.Unlock()
+}
+
+// Len returns the number of forwarders.
+func (f *Forwarders) Len() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return len(f.pools)
+}
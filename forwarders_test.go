@@ -0,0 +1,67 @@
+package veild
+
+import (
+	"testing"
+)
+
+func TestForwarders_Route(t *testing.T) {
+	forwarders := NewForwarders(newLogger())
+	fallback := NewPool(newLogger())
+
+	// Forwarders without resolvers so there's nothing to connect to.
+	forwarders.Reconcile([]ForwarderEntry{
+		{Name: "corp", Domains: []string{"corp.example.com", "10.in-addr.arpa"}},
+		{Name: "lab", Domains: []string{"lab.corp.example.com"}},
+	}, nil)
+
+	corp, lab := forwarders.pools["corp"], forwarders.pools["lab"]
+
+	tests := []struct {
+		host string
+		want *Pool
+	}{
+		{"corp.example.com", corp},
+		{"intranet.corp.example.com", corp},
+		{"1.0.0.10.in-addr.arpa", corp},
+		{"lab.corp.example.com", lab},
+		{"nas.lab.corp.example.com", lab},
+		{"example.com", fallback},
+		{"notcorp.example.com", fallback},
+	}
+
+	for _, tt := range tests {
+		if got := forwarders.Route(tt.host, fallback); got != tt.want {
+			t.Errorf("%s: routed to the wrong pool", tt.host)
+		}
+	}
+}
+
+func TestForwarders_Reconcile(t *testing.T) {
+	forwarders := NewForwarders(newLogger())
+	fallback := NewPool(newLogger())
+
+	forwarders.Reconcile([]ForwarderEntry{
+		{Name: "corp", Domains: []string{"corp.example.com"}},
+		{Name: "lab", Domains: []string{"home.arpa"}},
+	}, nil)
+	corp := forwarders.pools["corp"]
+
+	forwarders.Reconcile([]ForwarderEntry{
+		{Name: "corp", Domains: []string{"10.in-addr.arpa"}},
+	}, nil)
+
+	if forwarders.Len() != 1 {
+		t.Errorf("wanted 1 forwarder got %d", forwarders.Len())
+	}
+
+	// Forwarders which are kept keep their pool, with the new domains.
+	if got := forwarders.Route("1.0.0.10.in-addr.arpa", fallback); got != corp {
+		t.Error("expected forwarder to keep its pool")
+	}
+
+	for _, host := range []string{"corp.example.com", "nas.home.arpa"} {
+		if got := forwarders.Route(host, fallback); got != fallback {
+			t.Errorf("%s: expected removed domain to use the fallback", host)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package veild
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	// dohContentType is the media type for DNS messages over HTTPS.
+	// SEE: https://datatracker.ietf.org/doc/html/rfc8484#section-6
+	dohContentType = "application/dns-message"
+
+	// dohRequestTimeout is how long we wait on a single DoH exchange.
+	dohRequestTimeout = 5 * time.Second
+)
+
+// HTTPSResolverDialer connects to DNS-over-HTTPS resolvers.
+// SEE: https://datatracker.ietf.org/doc/html/rfc8484
+type HTTPSResolverDialer struct {
+	log *slog.Logger
+}
+
+// DialConn returns a connection which exchanges length prefixed DNS messages
+// with a DoH resolver. Queries are multiplexed over a single HTTP/2 connection
+// which the underlying transport (re)establishes as needed.
+func (h HTTPSResolverDialer) DialConn(re ResolverEntry) (io.ReadWriteCloser, error) {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig:   newTLSConfig(re),
+		ForceAttemptHTTP2: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// Use the configured address if we have one so that we don't
+			// need to resolve the hostname in the URL.
+			if re.Address != "" {
+				addr = re.Address
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+
+	c := &dohClient{
+		client: &http.Client{Transport: transport, Timeout: dohRequestTimeout},
+		url:    re.URL,
+		method: re.Method,
+		log:    h.log,
+	}
+
+	return newPipeConn(c.exchange, c.client.CloseIdleConnections), nil
+}
+
+// dohClient exchanges queries with a DoH resolver.
+type dohClient struct {
+	client *http.Client
+	url    string
+	method string
+	log    *slog.Logger
+}
+
+// exchange sends a query to the DoH resolver and returns its response.
+func (c *dohClient) exchange(query []byte) ([]byte, error) {
+	// Use an ID of 0 to make responses more cacheable.
+	// SEE: https://datatracker.ietf.org/doc/html/rfc8484#section-4.1
+	dohQuery := slices.Clone(query)
+	dohQuery[0], dohQuery[1] = 0x0, 0x0
+
+	response, err := c.roundTrip(dohQuery)
+	if err != nil {
+		if c.log != nil {
+			c.log.Warn("DoH request failed", "url", c.url, "err", err)
+		}
+		return nil, err
+	}
+
+	// Restore the original ID.
+	copy(response[:2], query[:2])
+
+	return response, nil
+}
+
+// roundTrip performs a single DoH request.
+func (c *dohClient) roundTrip(query []byte) ([]byte, error) {
+	var req *http.Request
+	var err error
+
+	if c.method == http.MethodGet {
+		req, err = http.NewRequest(http.MethodGet, c.url+"?dns="+base64.RawURLEncoding.EncodeToString(query), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, c.url, bytes.NewReader(query))
+		req.Header.Set("Content-Type", dohContentType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != dohContentType {
+		return nil, fmt.Errorf("unexpected content type: %s", contentType)
+	}
+
+	response, err := io.ReadAll(io.LimitReader(resp.Body, int64(maxMessageLength)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(response) < DNSHeaderLength {
+		return nil, ErrInvalidDNSPacket
+	}
+
+	return response, nil
+}
@@ -0,0 +1,118 @@
+package veild
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// newTestDoHServer starts a HTTP/2 DoH server which answers every query with
+// the protonmail.com fixture.
+func newTestDoHServer(t *testing.T, status int) *httptest.Server {
+	t.Helper()
+
+	response, _ := os.ReadFile("fixtures/response_protonmail.com_a.pkt")
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var query []byte
+
+		switch r.Method {
+		case http.MethodGet:
+			query, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			query, _ = io.ReadAll(r.Body)
+		}
+
+		if r.ProtoMajor != 2 || len(query) < DNSHeaderLength || query[0] != 0x0 || query[1] != 0x0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		if status != http.StatusOK {
+			http.Error(w, "error", status)
+			return
+		}
+
+		w.Header().Set("Content-Type", dohContentType)
+		w.Write(bytes.Clone(response))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// newTestDoHResolverEntry returns a ResolverEntry pinned to the test server's certificate.
+func newTestDoHResolverEntry(srv *httptest.Server, method string) ResolverEntry {
+	cert, _ := x509.ParseCertificate(srv.TLS.Certificates[0].Certificate[0])
+
+	return ResolverEntry{
+		URL:     srv.URL + "/dns-query",
+		Method:  method,
+		Pin:     PinSet{spkiFingerprint(cert)},
+		PinOnly: true,
+	}
+}
+
+func TestHTTPSResolverDialer_DialConn(t *testing.T) {
+	query, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+	response, _ := os.ReadFile("fixtures/response_protonmail.com_a.pkt")
+
+	srv := newTestDoHServer(t, http.StatusOK)
+
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		t.Run(method, func(t *testing.T) {
+			conn, err := HTTPSResolverDialer{}.DialConn(newTestDoHResolverEntry(srv, method))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write(packMessage(query)); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readMessage(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, response) {
+				t.Errorf("expected response to match fixture, got %v", got)
+			}
+		})
+	}
+}
+
+func TestHTTPSResolverDialer_DialConn_servfail(t *testing.T) {
+	query, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+
+	srv := newTestDoHServer(t, http.StatusInternalServerError)
+
+	conn, err := HTTPSResolverDialer{}.DialConn(newTestDoHResolverEntry(srv, http.MethodPost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write(packMessage(query))
+
+	got, err := readMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got[:2], query[:2]) {
+		t.Errorf("expected original ID to be restored, got %v", got[:2])
+	}
+
+	if rcode(got) != rcodeServFail {
+		t.Errorf("wanted SERVFAIL got rcode %d", rcode(got))
+	}
+}
@@ -0,0 +1,267 @@
+package veild
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Formats of blocklist (and allowlist) files.
+const (
+	// formatAuto detects the format of each line.
+	formatAuto = "auto"
+
+	// formatHosts is a hosts file, `0.0.0.0 example.com`.
+	formatHosts = "hosts"
+
+	// formatDomains is one domain per line, `example.com` or `*.example.com`.
+	formatDomains = "domains"
+
+	// formatAdblock is Adblock Plus syntax, `||example.com^` with `@@||example.com^`
+	// exceptions.
+	formatAdblock = "adblock"
+
+	// formatDnsmasq is dnsmasq config, `address=/example.com/` or `local=/example.com/`.
+	formatDnsmasq = "dnsmasq"
+)
+
+// ErrUnknownListFormat is returned for a list format that isn't supported.
+var ErrUnknownListFormat = fmt.Errorf("unknown list format, expected one of %s, %s, %s, %s or %s",
+	formatAuto, formatHosts, formatDomains, formatAdblock, formatDnsmasq)
+
+// hostsIgnored are the usual entries at the top of a hosts file which aren't
+// meant to be blocked.
+var hostsIgnored = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+	"ip6-localnet":          {},
+	"ip6-mcastprefix":       {},
+	"ip6-allnodes":          {},
+	"ip6-allrouters":        {},
+	"ip6-allhosts":          {},
+	"0.0.0.0":               {},
+}
+
+// lineResult is the outcome of parsing a single line of a list.
+type lineResult int
+
+const (
+	lineIgnored lineResult = iota
+	lineAccepted
+	lineInvalid
+)
+
+// listReport counts how the lines of a list were handled.
+type listReport struct {
+	accepted   int
+	exceptions int
+	ignored    int
+	invalid    int
+}
+
+// parsedList holds the rules from a list, exceptions override the rules.
+type parsedList struct {
+	rules      *domainTrie[struct{}]
+	exceptions *domainTrie[struct{}]
+	report     listReport
+}
+
+// validListFormat checks format is one we can parse, empty meaning formatAuto.
+func validListFormat(format string) bool {
+	switch format {
+	case "", formatAuto, formatHosts, formatDomains, formatAdblock, formatDnsmasq:
+		return true
+	}
+	return false
+}
+
+// parseList reads a list in the given format.
+func parseList(r io.Reader, format string) (*parsedList, error) {
+	if !validListFormat(format) {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownListFormat, format)
+	}
+
+	list := &parsedList{
+		rules:      &domainTrie[struct{}]{},
+		exceptions: &domainTrie[struct{}]{},
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		lineFormat := format
+		if lineFormat == "" || lineFormat == formatAuto {
+			lineFormat = detectLineFormat(line)
+		}
+
+		var domains []string
+		var exception bool
+		result := lineIgnored
+
+		switch lineFormat {
+		case formatHosts:
+			domains, result = parseHostsLine(line)
+		case formatDomains:
+			domains, result = parseDomainsLine(line)
+		case formatAdblock:
+			domains, exception, result = parseAdblockLine(line)
+		case formatDnsmasq:
+			domains, result = parseDnsmasqLine(line)
+		}
+
+		trie := list.rules
+		if exception {
+			trie = list.exceptions
+		}
+
+		for _, domain := range domains {
+			if !trie.Insert(domain, struct{}{}) {
+				result = lineInvalid
+			}
+		}
+
+		switch {
+		case result == lineAccepted && exception:
+			list.report.exceptions++
+		case result == lineAccepted:
+			list.report.accepted++
+		case result == lineInvalid:
+			list.report.invalid++
+		default:
+			list.report.ignored++
+		}
+	}
+
+	return list, scanner.Err()
+}
+
+// detectLineFormat works out which format a line is in from its shape.
+func detectLineFormat(line string) string {
+	switch {
+	case strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@"),
+		strings.HasPrefix(line, "!"), strings.HasPrefix(line, "["):
+		return formatAdblock
+	case strings.HasPrefix(line, "address="), strings.HasPrefix(line, "local="):
+		return formatDnsmasq
+	case len(strings.Fields(stripComment(line))) > 1:
+		return formatHosts
+	}
+	return formatDomains
+}
+
+// stripComment removes a trailing `#` comment from a line.
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i != -1 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+// parseHostsLine handles `IP hostname [hostname...]` lines.
+func parseHostsLine(line string) ([]string, lineResult) {
+	fields := strings.Fields(stripComment(line))
+	if len(fields) == 0 {
+		return nil, lineIgnored
+	}
+
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil, lineInvalid
+	}
+
+	var domains []string
+	for _, field := range fields[1:] {
+		if _, ok := hostsIgnored[strings.ToLower(field)]; !ok {
+			domains = append(domains, field)
+		}
+	}
+
+	if len(domains) == 0 {
+		return nil, lineIgnored
+	}
+
+	return domains, lineAccepted
+}
+
+// parseDomainsLine handles a single domain per line.
+func parseDomainsLine(line string) ([]string, lineResult) {
+	fields := strings.Fields(stripComment(line))
+	switch len(fields) {
+	case 0:
+		return nil, lineIgnored
+	case 1:
+		return fields, lineAccepted
+	}
+	return nil, lineInvalid
+}
+
+// parseAdblockLine handles the domain rules of Adblock Plus syntax, `||domain^`
+// blocks the domain and its subdomains, `@@||domain^` is an exception. Rules
+// with options, cosmetic rules and URL rules can't be applied to DNS so are
+// ignored.
+// SEE: https://help.adblockplus.org/hc/en-us/articles/360062733293
+func parseAdblockLine(line string) ([]string, bool, lineResult) {
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return nil, false, lineIgnored
+	}
+
+	rule, exception := strings.CutPrefix(line, "@@")
+
+	domain, ok := strings.CutPrefix(rule, "||")
+	if !ok || strings.Contains(domain, "$") {
+		return nil, false, lineIgnored
+	}
+
+	domain, ok = strings.CutSuffix(domain, "^")
+	if !ok || strings.ContainsAny(domain, "/^|") {
+		return nil, false, lineIgnored
+	}
+
+	return []string{domain}, exception, lineAccepted
+}
+
+// parseDnsmasqLine handles `address=/domain/[target]` and `local=/domain/`
+// lines, each of which can list several domains.
+// SEE: https://thekelleys.org.uk/dnsmasq/docs/dnsmasq-man.html
+func parseDnsmasqLine(line string) ([]string, lineResult) {
+	line = stripComment(line)
+	if line == "" {
+		return nil, lineIgnored
+	}
+
+	key, value, ok := strings.Cut(line, "=")
+	if !ok {
+		return nil, lineInvalid
+	}
+
+	switch key {
+	case "address", "local":
+	default:
+		return nil, lineIgnored
+	}
+
+	// The domains are between slashes with the target after the last one.
+	parts := strings.Split(value, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, lineInvalid
+	}
+
+	var domains []string
+	for _, domain := range parts[1 : len(parts)-1] {
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+
+	if len(domains) == 0 {
+		return nil, lineInvalid
+	}
+
+	return domains, lineAccepted
+}
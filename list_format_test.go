@@ -0,0 +1,95 @@
+package veild
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestListFormat_parseList(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     string
+		input      string
+		blocked    []string
+		allowed    []string
+		wantReport listReport
+	}{
+		{
+			name:       "hosts",
+			format:     formatHosts,
+			input:      "# Ads\n127.0.0.1 localhost\n0.0.0.0 ads.com tracker.com # both\nads.com\n",
+			blocked:    []string{"ads.com", "cdn.tracker.com"},
+			allowed:    []string{"localhost"},
+			wantReport: listReport{accepted: 1, ignored: 2, invalid: 1},
+		},
+		{
+			name:       "domains",
+			format:     formatDomains,
+			input:      "# Ads\nads.com\n*.tracker.com\n\n0.0.0.0 bad.com\n",
+			blocked:    []string{"ads.com", "www.tracker.com"},
+			allowed:    []string{"tracker.com", "bad.com"},
+			wantReport: listReport{accepted: 2, ignored: 2, invalid: 1},
+		},
+		{
+			name:       "adblock",
+			format:     formatAdblock,
+			input:      "[Adblock Plus 2.0]\n! Title: Ads\n||ads.com^\n@@||ok.ads.com^\n||tracker.com^$third-party\n##.banner\n",
+			blocked:    []string{"ads.com", "www.ads.com"},
+			allowed:    []string{"ok.ads.com", "tracker.com"},
+			wantReport: listReport{accepted: 1, exceptions: 1, ignored: 4},
+		},
+		{
+			name:       "dnsmasq",
+			format:     formatDnsmasq,
+			input:      "# Ads\naddress=/ads.com/0.0.0.0\nlocal=/tracker.com/metrics.com/\naddress=ads.com\ncache-size=1000\n",
+			blocked:    []string{"ads.com", "tracker.com", "a.metrics.com"},
+			wantReport: listReport{accepted: 2, ignored: 2, invalid: 1},
+		},
+		{
+			name:       "auto",
+			format:     formatAuto,
+			input:      "0.0.0.0 hosts.com\ndomain.com\n||adblock.com^\n@@||ok.adblock.com^\naddress=/dnsmasq.com/\n! comment\n# comment\n",
+			blocked:    []string{"hosts.com", "domain.com", "adblock.com", "dnsmasq.com"},
+			allowed:    []string{"ok.adblock.com"},
+			wantReport: listReport{accepted: 4, exceptions: 1, ignored: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := parseList(strings.NewReader(tt.input), tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if list.report != tt.wantReport {
+				t.Errorf("wanted report %+v got %+v", tt.wantReport, list.report)
+			}
+
+			blocked := func(host string) bool {
+				_, _, blocked := list.rules.Match(host)
+				_, _, excepted := list.exceptions.Match(host)
+				return blocked && !excepted
+			}
+
+			for _, host := range tt.blocked {
+				if !blocked(host) {
+					t.Errorf("expected %s to be blocked", host)
+				}
+			}
+
+			for _, host := range tt.allowed {
+				if blocked(host) {
+					t.Errorf("expected %s not to be blocked", host)
+				}
+			}
+		})
+	}
+}
+
+func TestListFormat_parseList_unknown(t *testing.T) {
+	if _, err := parseList(strings.NewReader(""), "pihole"); !errors.Is(err, ErrUnknownListFormat) {
+		t.Errorf("wanted ErrUnknownListFormat got %v", err)
+	}
+}
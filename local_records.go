@@ -0,0 +1,377 @@
+package veild
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultLocalTTL is the TTL, in seconds, of local records which don't set one.
+const defaultLocalTTL = 300
+
+// maxCNAMEChain is how many local CNAMEs are followed when answering a query.
+const maxCNAMEChain = 8
+
+// localRecordTypes are the record types which can be given in the local
+// records file.
+var localRecordTypes = map[string]uint16{
+	"A":     typeA,
+	"AAAA":  typeAAAA,
+	"CNAME": typeCNAME,
+	"PTR":   typePTR,
+	"SRV":   typeSRV,
+	"TXT":   typeTXT,
+}
+
+// LocalRecordEntry implements a record in the YAML local records file. Values
+// are given as they would be in a zone file, SRV values being `priority weight
+// port target`.
+type LocalRecordEntry struct {
+	Name  string
+	Type  string
+	Value string
+
+	// TTL is in seconds, defaulting to defaultLocalTTL.
+	TTL uint32
+}
+
+// LocalRecordEntries implements a list of local records.
+type LocalRecordEntries struct {
+	Records []LocalRecordEntry
+}
+
+var (
+	ErrReadingRecordsFile   = errors.New("reading local records file")
+	ErrUnmarshallingRecords = errors.New("error unmarshalling local records file")
+	ErrInvalidRecord        = errors.New("invalid local record")
+)
+
+// LocalRecords answers queries for names in the local records file
+// authoritatively, without going upstream.
+type LocalRecords struct {
+	mu sync.Mutex
+
+	// names maps each name to its records.
+	names map[string][]localRecord
+
+	log *slog.Logger
+}
+
+// localRecord is a record ready to be added to a response.
+type localRecord struct {
+	rType uint16
+	ttl   uint32
+	rdata []byte
+
+	// target is the name a CNAME points to.
+	target string
+}
+
+// NewLocalRecords loads local records from a file, either a YAML file (ending
+// in .yml or .yaml) or a hosts file. A PTR record is added for each address,
+// pointing to the first name given for it, unless there's one already.
+func NewLocalRecords(recordsPath string, logger *slog.Logger) (*LocalRecords, error) {
+	f, err := os.Open(recordsPath)
+	if err != nil {
+		return nil, errors.Join(ErrReadingRecordsFile, err)
+	}
+	defer f.Close()
+
+	var entries []LocalRecordEntry
+
+	switch filepath.Ext(recordsPath) {
+	case ".yml", ".yaml":
+		entries, err = parseRecordsYAML(f)
+	default:
+		entries, err = parseRecordsHosts(f)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	l := &LocalRecords{
+		names: make(map[string][]localRecord),
+		log:   logger.With("module", "records"),
+	}
+
+	if err := l.load(entries); err != nil {
+		return nil, errors.Join(ErrInvalidRecord, err)
+	}
+
+	return l, nil
+}
+
+// parseRecordsYAML reads the YAML form of the local records file.
+func parseRecordsYAML(r io.Reader) ([]LocalRecordEntry, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Join(ErrReadingRecordsFile, err)
+	}
+
+	records := &LocalRecordEntries{}
+	if err := yaml.Unmarshal(data, &records); err != nil {
+		return nil, errors.Join(ErrUnmarshallingRecords, err)
+	}
+
+	return records.Records, nil
+}
+
+// parseRecordsHosts reads `IP hostname [hostname...]` lines into A and AAAA
+// records.
+func parseRecordsHosts(r io.Reader) ([]LocalRecordEntry, error) {
+	var entries []LocalRecordEntry
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(stripComment(scanner.Text()))
+		if len(fields) == 0 {
+			continue
+		}
+
+		addr, err := netip.ParseAddr(fields[0])
+		if err != nil || len(fields) < 2 {
+			return nil, fmt.Errorf("%w: line %d: expected an address followed by names", ErrInvalidRecord, line)
+		}
+		addr = addr.WithZone("").Unmap()
+
+		rType := "A"
+		if addr.Is6() {
+			rType = "AAAA"
+		}
+
+		for _, name := range fields[1:] {
+			entries = append(entries, LocalRecordEntry{Name: name, Type: rType, Value: addr.String()})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Join(ErrReadingRecordsFile, err)
+	}
+
+	return entries, nil
+}
+
+// load adds the entries along with their PTR records. CNAMEs must point to
+// other local names as clients won't follow them elsewhere, rewrite rules
+// cover that instead.
+func (l *LocalRecords) load(entries []LocalRecordEntry) error {
+	var ptrs []LocalRecordEntry
+	reversed := make(map[string]struct{})
+
+	for _, entry := range entries {
+		name := normalizeDomain(entry.Name)
+		if !validDomain(name) {
+			return fmt.Errorf("%q: invalid name", entry.Name)
+		}
+
+		record, err := newLocalRecord(entry)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		records := l.names[name]
+		for _, existing := range records {
+			if existing.rType == typeCNAME || record.rType == typeCNAME {
+				return fmt.Errorf("%s: a CNAME can't be given with other records", name)
+			}
+		}
+		l.names[name] = append(records, record)
+
+		// The first name given for an address gets the PTR record.
+		if record.rType == typeA || record.rType == typeAAAA {
+			addr, _ := netip.AddrFromSlice(record.rdata)
+			reverse := reverseName(addr)
+			if _, ok := reversed[reverse]; !ok {
+				reversed[reverse] = struct{}{}
+				ptrs = append(ptrs, LocalRecordEntry{Name: reverse, Type: "PTR", Value: name, TTL: entry.TTL})
+			}
+		}
+	}
+
+	for _, ptr := range ptrs {
+		if _, ok := l.names[ptr.Name]; ok {
+			continue
+		}
+
+		record, err := newLocalRecord(ptr)
+		if err != nil {
+			return err
+		}
+		l.names[ptr.Name] = []localRecord{record}
+	}
+
+	for name, records := range l.names {
+		for _, record := range records {
+			if _, ok := l.names[record.target]; record.rType == typeCNAME && !ok {
+				return fmt.Errorf("%s: CNAME target %s isn't a local name", name, record.target)
+			}
+		}
+	}
+
+	return nil
+}
+
+// newLocalRecord converts an entry's value to wire format.
+func newLocalRecord(entry LocalRecordEntry) (localRecord, error) {
+	rType, ok := localRecordTypes[strings.ToUpper(entry.Type)]
+	if !ok {
+		return localRecord{}, fmt.Errorf("unsupported type %q", entry.Type)
+	}
+
+	record := localRecord{rType: rType, ttl: entry.TTL}
+	if record.ttl == 0 {
+		record.ttl = defaultLocalTTL
+	}
+
+	switch rType {
+	case typeA, typeAAAA:
+		addr, err := netip.ParseAddr(entry.Value)
+		if err != nil {
+			return record, err
+		}
+		addr = addr.WithZone("")
+
+		if (rType == typeA) != addr.Is4() {
+			return record, fmt.Errorf("%s isn't an %s address", entry.Value, entry.Type)
+		}
+		record.rdata = addr.AsSlice()
+	case typeCNAME, typePTR:
+		target := normalizeDomain(entry.Value)
+		if !validDomain(target) {
+			return record, fmt.Errorf("%q: invalid name", entry.Value)
+		}
+		record.rdata = encodeName(target)
+		record.target = target
+	case typeSRV:
+		fields := strings.Fields(entry.Value)
+		if len(fields) != 4 {
+			return record, fmt.Errorf("%q: expected priority, weight, port and target", entry.Value)
+		}
+
+		for _, field := range fields[:3] {
+			n, err := strconv.ParseUint(field, 10, 16)
+			if err != nil {
+				return record, fmt.Errorf("%q: %w", entry.Value, err)
+			}
+			record.rdata = binary.BigEndian.AppendUint16(record.rdata, uint16(n))
+		}
+
+		target := normalizeDomain(fields[3])
+		if target != "" && !validDomain(target) {
+			return record, fmt.Errorf("%q: invalid target", entry.Value)
+		}
+		record.rdata = append(record.rdata, encodeName(target)...)
+	case typeTXT:
+		// TXT data is a list of strings of up to 255 bytes each.
+		// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-3.3.14
+		value := entry.Value
+		for {
+			n := min(len(value), 255)
+			record.rdata = append(record.rdata, byte(n))
+			record.rdata = append(record.rdata, value[:n]...)
+			value = value[n:]
+			if value == "" {
+				break
+			}
+		}
+	}
+
+	return record, nil
+}
+
+// reverseName returns the in-addr.arpa or ip6.arpa name of an address.
+// SEE: https://datatracker.ietf.org/doc/html/rfc3596#section-2.5
+func reverseName(addr netip.Addr) string {
+	var labels []string
+
+	if addr.Is4() {
+		for _, b := range addr.AsSlice() {
+			labels = append([]string{strconv.Itoa(int(b))}, labels...)
+		}
+		return strings.Join(labels, ".") + ".in-addr.arpa"
+	}
+
+	for _, b := range addr.AsSlice() {
+		labels = append([]string{strconv.FormatUint(uint64(b&0xf), 16), strconv.FormatUint(uint64(b>>4), 16)}, labels...)
+	}
+	return strings.Join(labels, ".") + ".ip6.arpa"
+}
+
+// Answer forms an authoritative response to query, for host, if it's a local
+// name. CNAMEs to other local names are followed. Names with no records of
+// the type asked for are answered with NODATA.
+func (l *LocalRecords) Answer(query []byte, host string) ([]byte, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	name := normalizeDomain(host)
+	if _, ok := l.names[name]; !ok {
+		return nil, false
+	}
+
+	rType := questionType(query)
+	response := setFlags(newResponse(query, rcodeSuccess), flagAA)
+
+	// The first owner is the question's name, the rest are CNAME targets.
+	owner := []byte{0xc0, byte(DNSHeaderLength)}
+
+	for range maxCNAMEChain {
+		var cname *localRecord
+		answered := false
+
+		for _, record := range l.names[name] {
+			switch {
+			case record.rType == rType || rType == typeANY:
+				response = appendNamedRecord(response, answerCount, owner, record.rType, record.ttl, record.rdata)
+				answered = true
+			case record.rType == typeCNAME:
+				cname = &record
+			}
+		}
+
+		if answered || cname == nil {
+			break
+		}
+
+		response = appendNamedRecord(response, answerCount, owner, typeCNAME, cname.ttl, cname.rdata)
+
+		name = cname.target
+		if _, ok := l.names[name]; !ok {
+			break
+		}
+		owner = encodeName(name)
+	}
+
+	if binary.BigEndian.Uint16(response[answerCount:answerCount+2]) == 0 {
+		response = appendSOA(response, defaultLocalTTL)
+	}
+
+	return response, true
+}
+
+// replace swaps in the records from other.
+func (l *LocalRecords) replace(other *LocalRecords) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.names = other.names
+}
+
+// Len returns the number of local names.
+func (l *LocalRecords) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.names)
+}
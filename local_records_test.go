@@ -0,0 +1,157 @@
+package veild
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// answerStrings renders the answers of a response as `TYPE value`.
+func answerStrings(t *testing.T, response []byte) []string {
+	t.Helper()
+
+	msg, err := parseMessage(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var answers []string
+	for _, rr := range msg.answers {
+		rdata := response[rr.rdata : rr.rdata+rr.rdLength]
+
+		var value string
+		switch rr.rType {
+		case typeA, typeAAAA:
+			addr, _ := netip.AddrFromSlice(rdata)
+			value = addr.String()
+		case typeCNAME, typePTR:
+			value, _ = decodeName(response, rr.rdata)
+		case typeSRV:
+			target, _ := decodeName(response, rr.rdata+6)
+			value = fmt.Sprintf("%v %s", rdata[:6], target)
+		case typeTXT:
+			value = string(rdata[1:])
+		}
+
+		answers = append(answers, ResourceTypes[rr.rType]+" "+value)
+	}
+
+	return answers
+}
+
+func TestLocalRecords_Answer(t *testing.T) {
+	hosts, err := NewLocalRecords("fixtures/test_records.txt", newLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := NewLocalRecords("fixtures/test_records.yml", newLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		records *LocalRecords
+		host    string
+		rType   uint16
+		local   bool
+		answers []string
+	}{
+		{"hosts A", hosts, "nas.home.arpa", typeA, true, []string{"A 192.168.1.10"}},
+		{"hosts AAAA", hosts, "NAS.home.arpa", typeAAAA, true, []string{"AAAA fd00::10"}},
+		{"hosts alias", hosts, "nas", typeA, true, []string{"A 192.168.1.10"}},
+		{"hosts PTR", hosts, "10.1.168.192.in-addr.arpa", typePTR, true, []string{"PTR nas.home.arpa"}},
+		{"hosts IPv6 PTR", hosts, "0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", typePTR, true, []string{"PTR nas.home.arpa"}},
+		{"hosts nodata", hosts, "printer.home.arpa", typeAAAA, true, nil},
+		{"hosts ANY", hosts, "nas.home.arpa", typeANY, true, []string{"A 192.168.1.10", "AAAA fd00::10"}},
+		{"not local", hosts, "example.com", typeA, false, nil},
+		{"subdomain not local", hosts, "www.nas.home.arpa", typeA, false, nil},
+		{"CNAME followed", records, "files.home.arpa", typeA, true, []string{"CNAME nas.home.arpa", "A 192.168.1.10"}},
+		{"CNAME asked for", records, "files.home.arpa", typeCNAME, true, []string{"CNAME nas.home.arpa"}},
+		{"TXT", records, "home.arpa", typeTXT, true, []string{"TXT v=spf1 -all"}},
+		{"SRV", records, "_smb._tcp.home.arpa", typeSRV, true, []string{"SRV [0 0 0 5 1 189] nas.home.arpa"}},
+		{"explicit PTR", records, "10.1.168.192.in-addr.arpa", typePTR, true, []string{"PTR storage.home.arpa"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := newTestQuery(tt.host, tt.rType)
+
+			response, ok := tt.records.Answer(query, normalizeDomain(tt.host))
+			if ok != tt.local {
+				t.Fatalf("wanted local %v got %v", tt.local, ok)
+			}
+			if !ok {
+				return
+			}
+
+			if got := rcode(response); got != rcodeSuccess {
+				t.Errorf("wanted NOERROR got rcode %d", got)
+			}
+
+			if !slices.Equal(response[:2], query[:2]) || response[2]&0x04 == 0 {
+				t.Error("expected an authoritative answer to the query")
+			}
+
+			if got := answerStrings(t, response); !slices.Equal(got, tt.answers) {
+				t.Errorf("wanted answers %v got %v", tt.answers, got)
+			}
+
+			// Names without an answer are NODATA, with an SOA.
+			msg, _ := parseMessage(response)
+			if (len(tt.answers) == 0) != (len(msg.authority) == 1) {
+				t.Errorf("wanted SOA for NODATA only, got %d authority records", len(msg.authority))
+			}
+		})
+	}
+}
+
+func TestLocalRecords_NewLocalRecords_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    error
+	}{
+		{"bad address", "hosts", "192.168.1 nas\n", ErrInvalidRecord},
+		{"missing name", "hosts", "192.168.1.10\n", ErrInvalidRecord},
+		{"malformed", "records.yml", "records: [\n", ErrUnmarshallingRecords},
+		{"unsupported type", "records.yml", "records:\n  - {name: nas, type: MX, value: nas}\n", ErrInvalidRecord},
+		{"wrong address family", "records.yml", "records:\n  - {name: nas, type: A, value: \"fd00::10\"}\n", ErrInvalidRecord},
+		{"CNAME with others", "records.yml", "records:\n  - {name: nas, type: A, value: 192.168.1.10}\n  - {name: nas, type: CNAME, value: storage}\n", ErrInvalidRecord},
+		{"CNAME to another domain", "records.yml", "records:\n  - {name: files, type: CNAME, value: www.example.com}\n", ErrInvalidRecord},
+		{"bad SRV", "records.yml", "records:\n  - {name: _smb._tcp, type: SRV, value: \"0 5 nas\"}\n", ErrInvalidRecord},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			os.WriteFile(path, []byte(tt.content), 0o600)
+
+			if _, err := NewLocalRecords(path, newLogger()); !errors.Is(err, tt.want) {
+				t.Errorf("wanted %v got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func Test_reverseName(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"192.168.1.10", "10.1.168.192.in-addr.arpa"},
+		{"2001:db8::1", "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+
+	for _, tt := range tests {
+		if got := reverseName(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("%s: wanted %s got %s", tt.addr, tt.want, got)
+		}
+	}
+}
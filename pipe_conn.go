@@ -0,0 +1,68 @@
+package veild
+
+import (
+	"bytes"
+	"io"
+)
+
+// pipeConn adapts transports which exchange one query at a time, such as DoH
+// and plain UDP, to the length prefixed stream that a [Resolver] reads from and
+// writes to. Each query is passed to roundTrip in its own goroutine, failed
+// exchanges are answered with SERVFAIL.
+type pipeConn struct {
+	roundTrip func([]byte) ([]byte, error)
+	reader    *io.PipeReader
+	writer    *io.PipeWriter
+
+	// onClose, if set, is called when the connection is closed.
+	onClose func()
+}
+
+// newPipeConn returns a pipeConn which answers queries using roundTrip.
+func newPipeConn(roundTrip func([]byte) ([]byte, error), onClose func()) *pipeConn {
+	reader, writer := io.Pipe()
+
+	return &pipeConn{
+		roundTrip: roundTrip,
+		reader:    reader,
+		writer:    writer,
+		onClose:   onClose,
+	}
+}
+
+// Read reads length prefixed responses.
+func (c *pipeConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// Write takes a length prefixed query and sends it off to the resolver. The
+// response becomes available to Read once it arrives.
+func (c *pipeConn) Write(p []byte) (int, error) {
+	query, err := readMessage(bytes.NewReader(p))
+	if err != nil {
+		return 0, err
+	}
+
+	go c.exchange(query)
+
+	return len(p), nil
+}
+
+// Close closes the connection, pending responses are discarded.
+func (c *pipeConn) Close() error {
+	if c.onClose != nil {
+		c.onClose()
+	}
+	return c.writer.Close()
+}
+
+// exchange sends a query and makes its response available to Read.
+func (c *pipeConn) exchange(query []byte) {
+	response, err := c.roundTrip(query)
+	if err != nil {
+		response = newResponse(query, rcodeServFail)
+	}
+
+	// Errors here mean the connection has been closed.
+	c.writer.Write(packMessage(response))
+}
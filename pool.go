@@ -1,7 +1,9 @@
 package veild
 
 import (
+	"fmt"
 	"log/slog"
+	"sync"
 	"time"
 )
 
@@ -12,115 +14,293 @@ const (
 
 const statsFrequency = 10 * time.Second
 
+// timeoutFrequency is how often each worker checks for requests which have
+// timed out upstream.
+const timeoutFrequency = 250 * time.Millisecond
+
+// defaultUpstreamTimeout is used when config.UpstreamTimeout isn't set.
+const defaultUpstreamTimeout = 3 * time.Second
+
 // Pool represents a new connection pool.
 type Pool struct {
-	resolvers chan *Resolver
-	reconnect chan *Resolver
+	reconnect chan *member
 	requests  chan *Request
 	log       *slog.Logger
+
+	// live holds the resolvers with working connections, members the
+	// resolvers configured in the pool.
+	mu      sync.Mutex
+	live    map[*Resolver]struct{}
+	members map[string]*member
+}
+
+// member is a resolver configured in the pool. Its worker keeps a connection
+// open to the resolver until it's removed.
+type member struct {
+	entry  ResolverEntry
+	dialer ResolverDialer
+
+	// stopCh is closed when the resolver is removed from the pool.
+	stopCh chan struct{}
+}
+
+// stopped reports whether the member has been removed from the pool.
+func (m *member) stopped() bool {
+	select {
+	case <-m.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolverKey identifies a resolver's configuration, resolvers with the same
+// key are unchanged between reloads.
+func resolverKey(re ResolverEntry) string {
+	return fmt.Sprintf("%#v", re)
 }
 
 // NewPool creates a new connection pool.
-func NewPool(logger *slog.Logger, workerQueueSize int) *Pool {
+func NewPool(logger *slog.Logger) *Pool {
 	return &Pool{
-		resolvers: make(chan *Resolver, workerQueueSize),
-		reconnect: make(chan *Resolver, reconnectionQueueSize),
+		reconnect: make(chan *member, reconnectionQueueSize),
 		requests:  make(chan *Request, requestQueueSize),
 		log:       logger.With("module", "pool"),
+		live:      make(map[*Resolver]struct{}),
+		members:   make(map[string]*member),
 	}
 }
 
 // Stats prints out connection stats every x seconds.
 func (p *Pool) Stats() {
 	for {
-		p.log.Info("Stats", "requests", len(p.requests), "reconnecting", len(p.reconnect), "workers", len(p.resolvers))
+		p.log.Info("Stats", "requests", len(p.requests), "reconnecting", len(p.reconnect), "workers", p.liveCount())
 		time.Sleep(statsFrequency)
 	}
 }
 
 // ConnectionManagement management handles reconnects.
 func (p *Pool) ConnectionManagement() {
-	for resolver := range p.reconnect {
-		p.log.Debug("Reconnecting", "host", resolver.resolver.Address)
+	for m := range p.reconnect {
+		if m.stopped() {
+			continue
+		}
+
+		p.log.Debug("Reconnecting", "host", m.entry.Address)
 
 		// Let's see how many are reconnecting and how many workers we have.
-		p.log.Debug("Stats", "requests", len(p.requests), "reconnecting", len(p.reconnect), "workers", len(p.resolvers))
+		p.log.Debug("Stats", "requests", len(p.requests), "reconnecting", len(p.reconnect), "workers", p.liveCount())
 
-		rd := TLSResolverDialer{}
-		p.AddResolver(resolver.resolver, rd)
+		go p.worker(m)
 	}
 }
 
-// AddResolver adds a new worker to the pool.
+// AddResolver adds a new worker to the pool. Resolvers already in the pool
+// are skipped.
 func (p *Pool) AddResolver(resolver ResolverEntry, rd ResolverDialer) {
-	go p.worker(resolver, rd)
+	key := resolverKey(resolver)
+	m := &member{entry: resolver, dialer: rd, stopCh: make(chan struct{})}
+
+	p.mu.Lock()
+	if _, ok := p.members[key]; ok {
+		p.mu.Unlock()
+		p.log.Warn("Skipping duplicate resolver", "host", resolver.Address, "hostname", resolver.Hostname)
+		return
+	}
+	p.members[key] = m
+	p.mu.Unlock()
+
+	go p.worker(m)
+}
+
+// Reconcile brings the resolvers in the pool in line with resolvers. New
+// resolvers are added, removed ones are drained and closed and connections to
+// unchanged resolvers are left alone.
+func (p *Pool) Reconcile(resolvers []ResolverEntry, newDialer func(ResolverEntry) ResolverDialer) (added, removed, kept int) {
+	wanted := make(map[string]ResolverEntry, len(resolvers))
+	for _, re := range resolvers {
+		wanted[resolverKey(re)] = re
+	}
+
+	p.mu.Lock()
+	for key, m := range p.members {
+		if _, ok := wanted[key]; ok {
+			kept++
+			delete(wanted, key)
+			continue
+		}
+
+		p.log.Info("Removing resolver", "host", m.entry.Address, "hostname", m.entry.Hostname)
+		close(m.stopCh)
+		delete(p.members, key)
+		removed++
+	}
+	p.mu.Unlock()
+
+	// Add in the order they're listed, only once if they're listed twice.
+	for _, re := range resolvers {
+		key := resolverKey(re)
+		if _, ok := wanted[key]; ok {
+			p.log.Info("Adding resolver", "host", re.Address, "hostname", re.Hostname)
+			p.AddResolver(re, newDialer(re))
+			delete(wanted, key)
+			added++
+		}
+	}
+
+	return added, removed, kept
 }
 
 // worker creates a new underlying connection and assigns it a ResponseCache.
-func (p *Pool) worker(re ResolverEntry, rd ResolverDialer) {
+func (p *Pool) worker(m *member) {
+	re := m.entry
 
 	// Each resolver has it's own ResponseCache.
 	responseCache := NewResponseCache(p.log)
 
 	// Start a new connection.
-	// TODO: Return an error?
-	resolver, err := NewResolver(responseCache, re, rd, p.log)
+	resolver, err := newResolver(responseCache, re, m.dialer, m.stopCh, p.log)
 	if err != nil {
 		p.log.Warn("Failed to add a new connection", "host", re.Address, "err", err)
 		return
 	}
 
 	// Put the worker into the pool.
-	p.resolvers <- resolver
+	p.setLive(resolver, true)
+
+	ticker := time.NewTicker(timeoutFrequency)
+	defer ticker.Stop()
+
+	requests, stopCh := p.requests, m.stopCh
+	var drainDeadline time.Time
 
 	// Enter the loop for the worker.
 	for {
 		select {
 		case <-resolver.closeCh:
 			p.log.Debug("Resolver gone")
-			resolver.doneCh <- struct{}{}
+			p.setLive(resolver, false)
+
+			// Anything in flight on this connection won't be answered now.
+			for _, req := range responseCache.Drain() {
+				p.retry(req, resolver)
+			}
+
+			p.reconnect <- m
 			return
-		case req := <-p.requests:
+		case <-stopCh:
+			// Removed from the pool, stop taking requests and let the ones in
+			// flight finish before closing the connection.
+			p.log.Debug("Draining resolver", "host", re.Address, "in_flight", responseCache.Len())
+			p.setLive(resolver, false)
+			requests, stopCh = nil, nil
+			drainDeadline = time.Now().Add(upstreamTimeout())
+		case <-ticker.C:
+			for _, req := range responseCache.Expired(upstreamTimeout()) {
+				p.log.Debug("Request timed out", "host", re.Address, "retries", req.retries)
+				p.retry(req, resolver)
+			}
+
+			if !drainDeadline.IsZero() && (responseCache.Len() == 0 || time.Now().After(drainDeadline)) {
+				p.log.Debug("Resolver drained", "host", re.Address)
+				drainDeadline = time.Time{}
+				resolver.conn.Close()
+			}
+		case req := <-requests:
 			p.log.Debug("Pulled request from worker, pushing to upstream",
 				"host", re.Address, "resolver_requests", len(resolver.writeCh))
-			resolver.writeCh <- req
+			p.forward(resolver, req)
 		}
 	}
 }
 
-// Dispatch handles dispatching requests to the underlying workers.
-func (p *Pool) Dispatch() {
-	for {
-		p.log.Debug("Waiting for outgoing requests...")
+// upstreamTimeout returns how long to wait on a response from upstream before
+// retrying, config.UpstreamTimeout or defaultUpstreamTimeout if it isn't set.
+func upstreamTimeout() time.Duration {
+	if config.UpstreamTimeout <= 0 {
+		return defaultUpstreamTimeout
+	}
+	return config.UpstreamTimeout
+}
 
-		// Pull a request off.
-		request := <-p.requests
+// setLive marks a resolver as having a working connection, or not.
+func (p *Pool) setLive(resolver *Resolver, live bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		p.log.Debug("Workers and requests in pool", "workers", len(p.resolvers), "requests", len(p.requests))
+	if live {
+		p.live[resolver] = struct{}{}
+	} else {
+		delete(p.live, resolver)
+	}
+}
 
-		// Pull a worker off.
-		resolver := <-p.resolvers
+// liveCount returns the number of resolvers with working connections.
+func (p *Pool) liveCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-		p.log.Debug("Worker picked up", "worker", resolver.resolver.Hostname)
+	return len(p.live)
+}
 
-		select {
-		case <-resolver.doneCh:
-			// Worker is down, reconnect and re-queue request.
-			p.reconnect <- resolver
-			p.requests <- request
+// pick returns a live resolver other than exclude, or nil if there isn't one.
+func (p *Pool) pick(exclude *Resolver) *Resolver {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-			p.log.Debug("Worker down", "worker", resolver.resolver.Hostname)
+	for resolver := range p.live {
+		if resolver != exclude {
+			return resolver
+		}
+	}
+	return nil
+}
 
-		default:
-			// Else, put the worker back into the pool and
-			// stick the request back on the requests queue.
-			p.log.Debug("Worker still alive, forwarding request", "worker", resolver.resolver.Hostname)
+// enqueue adds a request to the pool's queue, making room by dropping the
+// oldest request if the queue is full.
+func (p *Pool) enqueue(request *Request) {
+	request.pool = p
 
-			p.resolvers <- resolver
-			p.requests <- request
+	select {
+	case p.requests <- request:
+		p.log.Debug("Request added to pool", "context", "pool")
+	default:
+		p.log.Debug("Dropping oldest request", "context", "pool")
+		<-p.requests
+		p.requests <- request
+	}
+}
 
-			p.log.Debug("Worker returned to pool", "worker", resolver.resolver.Hostname)
+// forward hands a request to a resolver. Retried requests are sent to a
+// different resolver from the one that failed them, if there is one.
+func (p *Pool) forward(resolver *Resolver, request *Request) {
+	if request.exclude == resolver {
+		if other := p.pick(resolver); other != nil {
+			resolver = other
 		}
+	}
 
+	select {
+	case resolver.writeCh <- request:
+	case <-resolver.closeCh:
+		// The resolver's gone, put it back for another to pick up.
+		p.enqueue(request)
 	}
 }
+
+// retry re-queues a request which didn't get a response from a resolver.
+// Once a request has run out of retries the client is sent a stale response
+// if there is one, otherwise SERVFAIL.
+func (p *Pool) retry(request *Request, from *Resolver) {
+	if request.retries >= config.UpstreamRetries {
+		p.log.Warn("Request failed, no retries left", "retries", request.retries, "elapsed", time.Since(request.start))
+		if !serveStaleAndRefresh(p, request) {
+			request.write(newResponse(request.data, rcodeServFail))
+		}
+		return
+	}
+
+	request.retries++
+	request.exclude = from
+	p.enqueue(request)
+}
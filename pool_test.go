@@ -0,0 +1,242 @@
+package veild
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestResolver returns a Resolver with no underlying connection.
+func newTestResolver() *Resolver {
+	return &Resolver{
+		writeCh: make(chan *Request, 1),
+		closeCh: make(chan struct{}),
+	}
+}
+
+// pipeDialer dials in-memory connections, handing the upstream end of each
+// back on conns.
+type pipeDialer struct {
+	conns chan net.Conn
+}
+
+func (d pipeDialer) DialConn(re ResolverEntry) (io.ReadWriteCloser, error) {
+	client, upstream := net.Pipe()
+	d.conns <- upstream
+	return client, nil
+}
+
+// waitFor polls cond until it's true or a second has passed.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPool_Reconcile(t *testing.T) {
+	config = &Config{UpstreamTimeout: time.Second}
+
+	pool := NewPool(newLogger())
+
+	dialer := pipeDialer{conns: make(chan net.Conn, 3)}
+	newDialer := func(ResolverEntry) ResolverDialer { return dialer }
+
+	removed, unchanged := ResolverEntry{Address: "removed:853"}, ResolverEntry{Address: "unchanged:853"}
+
+	pool.AddResolver(removed, dialer)
+	removedConn := <-dialer.conns
+	pool.AddResolver(unchanged, dialer)
+	<-dialer.conns
+
+	waitFor(t, func() bool { return pool.liveCount() == 2 })
+
+	added, gone, kept := pool.Reconcile([]ResolverEntry{unchanged, {Address: "added:853"}}, newDialer)
+	if added != 1 || gone != 1 || kept != 1 {
+		t.Errorf("wanted 1 added, 1 removed and 1 kept got %d, %d and %d", added, gone, kept)
+	}
+
+	// Only the new resolver is dialed.
+	<-dialer.conns
+
+	// The removed resolver's connection is closed once it's drained.
+	removedConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := removedConn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected removed resolver to be closed, got %v", err)
+	}
+
+	// Its worker hands it back to be reconnected, which is skipped as it's stopped.
+	if m := <-pool.reconnect; m.entry.Address != removed.Address || !m.stopped() {
+		t.Errorf("expected removed resolver to be stopped, got %+v", m.entry)
+	}
+
+	waitFor(t, func() bool { return pool.liveCount() == 2 })
+
+	// Remove the rest and wait on their workers to finish.
+	pool.Reconcile(nil, newDialer)
+	<-pool.reconnect
+	<-pool.reconnect
+}
+
+func TestPool_Reconcile_duplicates(t *testing.T) {
+	config = &Config{UpstreamTimeout: time.Second}
+
+	pool := NewPool(newLogger())
+
+	dialer := pipeDialer{conns: make(chan net.Conn, 3)}
+	newDialer := func(ResolverEntry) ResolverDialer { return dialer }
+
+	duplicate := ResolverEntry{Address: "duplicate:853"}
+
+	pool.AddResolver(duplicate, dialer)
+	pool.AddResolver(duplicate, dialer)
+	<-dialer.conns
+
+	added, _, kept := pool.Reconcile([]ResolverEntry{duplicate, {Address: "added:853"}, {Address: "added:853"}}, newDialer)
+	if added != 1 || kept != 1 {
+		t.Errorf("wanted 1 added and 1 kept got %d and %d", added, kept)
+	}
+	<-dialer.conns
+
+	waitFor(t, func() bool { return pool.liveCount() == 2 })
+
+	// Each resolver only has the one worker, which stops when it's removed.
+	pool.Reconcile(nil, newDialer)
+	<-pool.reconnect
+	<-pool.reconnect
+
+	if len(dialer.conns) != 0 {
+		t.Errorf("expected each resolver to be dialed once, got %d more", len(dialer.conns))
+	}
+	waitFor(t, func() bool { return pool.liveCount() == 0 })
+}
+
+func TestPool_worker_defaultTimeout(t *testing.T) {
+	config = &Config{}
+
+	pool := NewPool(newLogger())
+
+	dialer := pipeDialer{conns: make(chan net.Conn, 1)}
+	pool.AddResolver(ResolverEntry{Address: "upstream:853"}, dialer)
+	upstream := <-dialer.conns
+
+	responses := make(chanConn, 1)
+	request := newRequest()
+	request.clientConn = responses
+	pool.enqueue(request)
+
+	if _, err := readMessage(upstream); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a timeout configured the request is still waiting on upstream
+	// after a few sweeps.
+	select {
+	case response := <-responses:
+		t.Errorf("expected request to wait on upstream, got rcode %d", rcode(response))
+	case <-time.After(4 * timeoutFrequency):
+	}
+
+	pool.Reconcile(nil, func(ResolverEntry) ResolverDialer { return dialer })
+	upstream.Close()
+	<-pool.reconnect
+}
+
+func TestPool_retry(t *testing.T) {
+	config = &Config{UpstreamRetries: 1}
+
+	pool := NewPool(newLogger())
+	resolver := newTestResolver()
+
+	conn := &captureConn{}
+	request := newRequest()
+	request.clientConn = conn
+
+	// First time round the request goes back on the queue.
+	pool.retry(request, resolver)
+
+	if got := <-pool.requests; got != request || got.exclude != resolver {
+		t.Error("expected request to be re-queued avoiding the resolver")
+	}
+
+	// Second time round it's run out of retries.
+	pool.retry(request, resolver)
+
+	if conn.written == nil || rcode(conn.written) != rcodeServFail {
+		t.Error("expected SERVFAIL once retries are exhausted")
+	}
+}
+
+func TestPool_retry_stale(t *testing.T) {
+	config = &Config{CachingEnabled: true}
+	queryCache = NewQueryCache(newLogger(), 0, 0, time.Hour)
+
+	stale := newCachedQuery("protonmail.com", 60)
+	stale.creation = time.Now().Add(-2 * time.Minute)
+	queryCache.Set(stale)
+
+	pool := NewPool(newLogger())
+
+	conn := &captureConn{}
+	request := newRequest()
+	request.clientConn = conn
+
+	pool.retry(request, newTestResolver())
+
+	if conn.written == nil || rcode(conn.written) != rcodeSuccess {
+		t.Fatal("expected stale response once retries are exhausted")
+	}
+
+	if !bytes.Equal(conn.written[:2], request.data[:2]) {
+		t.Error("expected stale response to carry the client's transaction ID")
+	}
+
+	// The entry is refreshed in the background.
+	if got := <-pool.requests; !got.background || !bytes.Equal(got.data, request.data) {
+		t.Error("expected a background request to refresh the stale entry")
+	}
+}
+
+func TestPool_forward(t *testing.T) {
+	pool := NewPool(newLogger())
+
+	failed, other := newTestResolver(), newTestResolver()
+	pool.setLive(failed, true)
+	pool.setLive(other, true)
+
+	request := newRequest()
+	request.exclude = failed
+
+	pool.forward(failed, request)
+
+	select {
+	case got := <-other.writeCh:
+		if got != request {
+			t.Error("unexpected request")
+		}
+	default:
+		t.Error("expected request to be forwarded to the other resolver")
+	}
+}
+
+func TestPool_forward_closed(t *testing.T) {
+	pool := NewPool(newLogger())
+
+	resolver := newTestResolver()
+	resolver.writeCh = make(chan *Request)
+	close(resolver.closeCh)
+
+	request := newRequest()
+	pool.forward(resolver, request)
+
+	if got := <-pool.requests; got != request {
+		t.Error("expected request to be re-queued when the resolver has gone")
+	}
+}
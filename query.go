@@ -2,14 +2,132 @@ package veild
 
 import (
 	"encoding/binary"
+	"errors"
+	"slices"
 	"time"
 )
 
+// typeSOA is the RR type of an SOA record.
+const typeSOA uint16 = 6
+
+// ErrNotCacheable is returned for responses which shouldn't be cached.
+var ErrNotCacheable = errors.New("response not cacheable")
+
 // Query holds the structure for the raw response data and offsets of TTLs.
 type Query struct {
 	data     []byte
 	offsets  []int
 	creation time.Time
+
+	// ttls are upstream's TTLs at each offset, sent to clients in place of the
+	// clamped TTLs in data unless config.RewriteTTL is set.
+	ttls []uint32
+
+	// hits counts cache hits, used to decide whether to prefetch the entry.
+	hits uint64
+	// prefetched is set once a refresh has been sent upstream.
+	prefetched bool
+}
+
+// queryFromResponse prepares a response from upstream for the query cache.
+// Negative responses (NXDOMAIN and NODATA) are cached for the negative TTL
+// taken from the SOA record in the authority section.
+// SEE: https://datatracker.ietf.org/doc/html/rfc2308#section-5
+func queryFromResponse(data []byte) (*Query, error) {
+	msg, err := parseMessage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only successful and NXDOMAIN responses are cached.
+	rc := rcode(data)
+	if rc != rcodeSuccess && rc != rcodeNXDomain {
+		return nil, ErrNotCacheable
+	}
+
+	// Take a copy as we'll be adjusting the TTLs.
+	data = slices.Clone(data)
+
+	// Keep upstream's TTLs to pass on to clients, the clamped ones decide how
+	// long the entry is cached for.
+	var ttls []uint32
+	if !config.RewriteTTL {
+		for _, rr := range append(msg.answers, msg.authority...) {
+			ttls = append(ttls, binary.BigEndian.Uint32(data[rr.ttl:rr.ttl+4]))
+		}
+	}
+
+	offsets, ok := clampTTLs(data, msg)
+	if !ok {
+		// Negative responses without an SOA shouldn't be cached.
+		return nil, ErrNotCacheable
+	}
+
+	// Only cache if there are TTLs to decrement otherwise the cache will
+	// get filled with entries that can't be evicted.
+	if len(offsets) == 0 {
+		return nil, ErrNotCacheable
+	}
+
+	return &Query{data: data, offsets: offsets, creation: time.Now(), ttls: ttls}, nil
+}
+
+// clampTTLs limits the TTLs of the answer and authority records in data to
+// between config.MinTTL and config.MaxTTL, returning their offsets. Negative
+// responses are limited to the negative TTL instead of config.MaxTTL, false is
+// returned if there's no SOA record to take it from. They're then capped to
+// config.MaxNegativeTTL, even if that's below config.MinTTL.
+func clampTTLs(data []byte, msg *message) ([]int, bool) {
+	upper, capped := uint32(config.MaxTTL.Seconds()), config.MaxTTL > 0
+	negative := rcode(data) == rcodeNXDomain || len(msg.answers) == 0
+
+	if negative {
+		ttl, ok := negativeTTL(data, msg)
+		if !ok {
+			return nil, false
+		}
+		upper, capped = ttl, true
+	}
+
+	lower := uint32(config.MinTTL.Seconds())
+	maxNegative := uint32(config.MaxNegativeTTL.Seconds())
+
+	var offsets []int
+	for _, rr := range append(msg.answers, msg.authority...) {
+		ttl := binary.BigEndian.Uint32(data[rr.ttl : rr.ttl+4])
+		if capped {
+			ttl = min(ttl, upper)
+		}
+		ttl = max(ttl, lower)
+		if negative && maxNegative > 0 {
+			ttl = min(ttl, maxNegative)
+		}
+		binary.BigEndian.PutUint32(data[rr.ttl:rr.ttl+4], ttl)
+		offsets = append(offsets, rr.ttl)
+	}
+
+	return offsets, true
+}
+
+// negativeTTL returns the TTL for a negative response, the minimum of the SOA
+// record's TTL and its MINIMUM field.
+// SEE: https://datatracker.ietf.org/doc/html/rfc2308#section-3
+func negativeTTL(data []byte, msg *message) (uint32, bool) {
+	for _, rr := range msg.authority {
+		// MINIMUM is the last field of the SOA RDATA.
+		if rr.rType != typeSOA || rr.rdLength < 22 {
+			continue
+		}
+
+		ttl := min(
+			binary.BigEndian.Uint32(data[rr.ttl:rr.ttl+4]),
+			binary.BigEndian.Uint32(data[rr.end()-4:rr.end()]),
+		)
+
+		return ttl, true
+	}
+
+	return 0, false
 }
 
 func (q *Query) cacheKey() cacheKey {
@@ -33,6 +151,44 @@ func (q *Query) decTTL(decrementBy uint32) bool {
 	return true
 }
 
+// ttl returns the smallest TTL in the query.
+func (q *Query) ttl() uint32 {
+	if len(q.offsets) == 0 {
+		return 0
+	}
+	return slices.Min(q.getTTLs())
+}
+
+// expires returns when the smallest TTL in the query runs out.
+func (q *Query) expires() time.Time {
+	return q.creation.Add(time.Duration(q.ttl()) * time.Second)
+}
+
+// decremented returns a copy of the query with the TTLs decremented by the time
+// it's spent in the cache. Upstream's TTLs are used if they were kept, these
+// can run down to 0 before the entry expires if they were raised by clamping.
+func (q *Query) decremented(now time.Time) *Query {
+	age := uint32(now.Sub(q.creation).Seconds())
+
+	query := &Query{data: slices.Clone(q.data), offsets: q.offsets, creation: now}
+	query.decTTL(age)
+
+	for i, ttl := range q.ttls {
+		binary.BigEndian.PutUint32(query.data[q.offsets[i]:q.offsets[i]+4], ttl-min(ttl, age))
+	}
+
+	return query
+}
+
+// stale returns a copy of the query with all the TTLs set to ttl.
+func (q *Query) stale(ttl uint32, now time.Time) *Query {
+	query := &Query{data: slices.Clone(q.data), offsets: q.offsets, creation: now}
+	for _, offset := range query.offsets {
+		binary.BigEndian.PutUint32(query.data[offset:offset+4], ttl)
+	}
+	return query
+}
+
 // getTTLs gets the TTLs from the offsets using the data.
 func (q *Query) getTTLs() []uint32 {
 	ttls := []uint32{}
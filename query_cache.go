@@ -1,6 +1,7 @@
 package veild
 
 import (
+	"container/list"
 	"fmt"
 	"io"
 	"log/slog"
@@ -8,62 +9,202 @@ import (
 	"time"
 )
 
-// QueryCache holds the main structure of the query cache.
+// staleTTL is the TTL given to stale responses.
+// SEE: https://datatracker.ietf.org/doc/html/rfc8767#section-4
+const staleTTL = 30
+
+// queryOverhead is a rough estimate of the bytes used by each entry in the
+// cache on top of the response itself (map entry, list element, Query etc).
+const queryOverhead = 128
+
+// QueryCache holds the main structure of the query cache. Entries are
+// evicted least recently used first once the cache grows beyond either
+// maxEntries or maxBytes (0 means no limit). Expired entries are kept for
+// staleWindow so they can be served if upstream resolution fails.
 type QueryCache struct {
 	mu      sync.RWMutex
-	queries map[cacheKey]*Query
+	queries map[cacheKey]*list.Element
+	lru     *list.List
 	log     *slog.Logger
+
+	maxEntries  int
+	maxBytes    int
+	staleWindow time.Duration
+	bytes       int
+	evictions   uint64
+
+	// Prefetches are limited to config.PrefetchRate per second.
+	prefetchWindow time.Time
+	prefetchCount  int
+	prefetches     uint64
 }
 
 // NewQueryCache handles QueryCache initialization.
-func NewQueryCache(logger *slog.Logger) *QueryCache {
+func NewQueryCache(logger *slog.Logger, maxEntries, maxBytes int, staleWindow time.Duration) *QueryCache {
 	return &QueryCache{
-		queries: make(map[cacheKey]*Query),
-		log:     logger.With("module", "query_cache"),
+		queries:     make(map[cacheKey]*list.Element),
+		lru:         list.New(),
+		log:         logger.With("module", "query_cache"),
+		maxEntries:  maxEntries,
+		maxBytes:    maxBytes,
+		staleWindow: staleWindow,
 	}
 }
 
+// size returns the approximate memory used by a query.
+func (q *Query) size() int {
+	return len(q.data) + len(q.offsets)*8 + len(q.ttls)*4 + queryOverhead
+}
+
 func (qc *QueryCache) Set(value *Query) {
 	qc.mu.Lock()
 	defer qc.mu.Unlock()
 
-	qc.queries[value.cacheKey()] = value
+	key := value.cacheKey()
+
+	if elem, ok := qc.queries[key]; ok {
+		qc.bytes -= elem.Value.(*Query).size()
+		elem.Value = value
+		qc.lru.MoveToFront(elem)
+	} else {
+		qc.queries[key] = qc.lru.PushFront(value)
+	}
+	qc.bytes += value.size()
+
+	qc.evict()
+}
+
+// evict removes the least recently used entries until the cache is within its limits.
+func (qc *QueryCache) evict() {
+	for qc.lru.Len() > 0 &&
+		((qc.maxEntries > 0 && qc.lru.Len() > qc.maxEntries) || (qc.maxBytes > 0 && qc.bytes > qc.maxBytes)) {
+
+		elem := qc.lru.Back()
+		key := elem.Value.(*Query).cacheKey()
+
+		qc.log.Debug("Evicting cache entry", "entry", key)
+		qc.remove(key, elem)
+		qc.evictions++
+	}
+}
+
+// remove deletes an entry from the cache.
+func (qc *QueryCache) remove(key cacheKey, elem *list.Element) {
+	qc.bytes -= elem.Value.(*Query).size()
+	qc.lru.Remove(elem)
+	delete(qc.queries, key)
 }
 
-// Get gets an entry from the query cache.
+// Get gets an entry from the query cache. The entry returned is a copy with
+// the TTLs decremented by the time spent in the cache.
 func (qc *QueryCache) Get(key cacheKey) (*Query, bool) {
 	qc.mu.Lock()
 	defer qc.mu.Unlock()
 
-	if query, ok := qc.queries[key]; ok {
-		// Try decrementing the TTL by n seconds.
-		decBy := uint32(time.Since(query.creation).Seconds())
+	if elem, ok := qc.queries[key]; ok {
+		query := elem.Value.(*Query)
+		now := time.Now()
 
-		if query.decTTL(decBy) {
-			return query, true
+		if now.Before(query.expires()) {
+			qc.lru.MoveToFront(elem)
+			query.hits++
+			return query.decremented(now), true
+		}
+
+		// Keep hold of it while it can still be served stale.
+		if now.Before(query.expires().Add(qc.staleWindow)) {
+			return nil, false
 		}
 
 		// Remove it, must be too old.
 		qc.log.Debug("Removing cache entry", "entry", key)
-		delete(qc.queries, key)
+		qc.remove(key, elem)
 	}
 
 	return nil, false
 }
 
-// Entries outputs all the current entries in the cache along with their TTLs.
+// Prefetch reports whether an entry should be refreshed before it expires.
+// That's once it's had config.PrefetchHits hits and is within
+// config.PrefetchThreshold of its original TTL. Each entry is only prefetched
+// once and prefetches are rate limited.
+func (qc *QueryCache) Prefetch(key cacheKey) bool {
+	if config.PrefetchHits <= 0 {
+		return false
+	}
+
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	elem, ok := qc.queries[key]
+	if !ok {
+		return false
+	}
+
+	query := elem.Value.(*Query)
+	if query.prefetched || query.hits < uint64(config.PrefetchHits) {
+		return false
+	}
+
+	now := time.Now()
+	threshold := time.Duration(float64(query.ttl()) * config.PrefetchThreshold * float64(time.Second))
+	if query.expires().Sub(now) > threshold {
+		return false
+	}
+
+	// Start a new window every second.
+	if now.Sub(qc.prefetchWindow) >= time.Second {
+		qc.prefetchWindow = now
+		qc.prefetchCount = 0
+	}
+
+	if qc.prefetchCount >= config.PrefetchRate {
+		return false
+	}
+
+	qc.prefetchCount++
+	qc.prefetches++
+	query.prefetched = true
+
+	return true
+}
+
+// GetStale gets an expired entry from the query cache, if it's still within
+// the stale window. The entry returned is a copy with the TTLs set to staleTTL.
+// SEE: https://datatracker.ietf.org/doc/html/rfc8767
+func (qc *QueryCache) GetStale(key cacheKey) (*Query, bool) {
+	qc.mu.Lock()
+	defer qc.mu.Unlock()
+
+	if elem, ok := qc.queries[key]; ok {
+		query := elem.Value.(*Query)
+		now := time.Now()
+
+		if now.Before(query.expires().Add(qc.staleWindow)) {
+			return query.stale(staleTTL, now), true
+		}
+	}
+
+	return nil, false
+}
+
+// Entries outputs all the current entries in the cache along with their TTLs,
+// most recently used first.
 func (qc *QueryCache) Entries(f io.Writer) {
 	qc.mu.Lock()
 	defer qc.mu.Unlock()
 
-	for _, query := range qc.queries {
+	now := time.Now()
+
+	for elem := qc.lru.Front(); elem != nil; elem = elem.Next() {
+		query := elem.Value.(*Query).decremented(now)
 		rr, _ := NewRR(query.data[DNSHeaderLength:])
 		ttls := query.getTTLs()
 		fmt.Fprintf(f, "%s, %s, %+v\n", rr.hostname, rr.rType, ttls)
 	}
 }
 
-// Reaper ticks over and runs through the TTL decrements.
+// Reaper ticks over and removes entries which have expired and are past the stale window.
 func (qc *QueryCache) Reaper() {
 	for {
 		qc.reaper()
@@ -79,21 +220,19 @@ func (qc *QueryCache) reaper() {
 	qc.mu.Lock()
 	defer qc.mu.Unlock()
 
-	for cacheKey, query := range qc.queries {
-		now := time.Now()
-
-		decBy := uint32(now.Sub(query.creation).Seconds())
+	for cacheKey, elem := range qc.queries {
+		query := elem.Value.(*Query)
 
-		if query.decTTL(decBy) {
-			qc.queries[cacheKey] = &Query{query.data, query.offsets, now}
+		if t.Before(query.expires().Add(qc.staleWindow)) {
 			continue
 		}
 		qc.log.Debug("Removing cache entry", "entry", cacheKey, "context", "reaper")
-		delete(qc.queries, cacheKey)
+		qc.remove(cacheKey, elem)
 	}
 
 	elapsed := time.Since(t)
 	numEntries := len(qc.queries)
 
 	qc.log.Debug("Spent in loop", "elapsed", elapsed, "entries", numEntries)
+	qc.log.Info("Stats", "entries", numEntries, "bytes", qc.bytes, "evictions", qc.evictions, "prefetches", qc.prefetches, "context", "stats")
 }
@@ -0,0 +1,179 @@
+package veild
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// snapshotMagic identifies a query cache snapshot file.
+	snapshotMagic = "VLDC"
+
+	// snapshotVersion is bumped whenever the snapshot format changes.
+	snapshotVersion uint16 = 1
+
+	// snapshotHeaderLength is the magic, version and CRC-32 of the payload.
+	snapshotHeaderLength = len(snapshotMagic) + 2 + 4
+
+	// snapshotFrequency is how often the cache is written out to disk.
+	snapshotFrequency = 5 * time.Minute
+)
+
+var (
+	ErrInvalidSnapshot            = errors.New("invalid cache snapshot")
+	ErrUnsupportedSnapshotVersion = errors.New("unsupported cache snapshot version")
+)
+
+// snapshotEntry is a cache entry as stored on disk.
+type snapshotEntry struct {
+	Data     []byte
+	Offsets  []int
+	Creation time.Time
+	Expires  time.Time
+	TTLs     []uint32
+}
+
+// Save writes the cache out to path. The file is replaced atomically so a
+// crash part way through never leaves a truncated snapshot behind.
+func (qc *QueryCache) Save(path string) error {
+	qc.mu.Lock()
+
+	// Least recently used first so that loading restores the LRU order.
+	entries := make([]snapshotEntry, 0, qc.lru.Len())
+	for elem := qc.lru.Back(); elem != nil; elem = elem.Prev() {
+		query := elem.Value.(*Query)
+		entries = append(entries, snapshotEntry{
+			Data:     query.data,
+			Offsets:  query.offsets,
+			Creation: query.creation,
+			Expires:  query.expires(),
+			TTLs:     query.ttls,
+		})
+	}
+
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(entries)
+	qc.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, snapshotHeaderLength)
+	header = append(header, snapshotMagic...)
+	header = binary.BigEndian.AppendUint16(header, snapshotVersion)
+	header = binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(payload.Bytes()))
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(append(header, payload.Bytes()...)); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+
+	qc.log.Debug("Saved cache snapshot", "entries", len(entries), "path", path)
+
+	return nil
+}
+
+// Load reads a snapshot written by Save into the cache, skipping entries which
+// have expired since. TTLs are decremented for the time spent on disk as the
+// original creation times are kept. Returns the number of entries loaded.
+func (qc *QueryCache) Load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(data) < snapshotHeaderLength || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, ErrInvalidSnapshot
+	}
+
+	header := data[len(snapshotMagic):snapshotHeaderLength]
+	if version := binary.BigEndian.Uint16(header[:2]); version != snapshotVersion {
+		return 0, fmt.Errorf("%w: %d", ErrUnsupportedSnapshotVersion, version)
+	}
+
+	payload := data[snapshotHeaderLength:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[2:]) {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+	}
+
+	var entries []snapshotEntry
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&entries); err != nil {
+		return 0, errors.Join(ErrInvalidSnapshot, err)
+	}
+
+	now := time.Now()
+	loaded := 0
+
+	for _, entry := range entries {
+		if !now.Before(entry.Expires) {
+			continue
+		}
+
+		// Don't trust the offsets to be within the data.
+		if !validOffsets(entry.Data, entry.Offsets) {
+			continue
+		}
+
+		// Without upstream's TTLs clients get the clamped ones.
+		if len(entry.TTLs) != len(entry.Offsets) {
+			entry.TTLs = nil
+		}
+
+		qc.Set(&Query{data: entry.Data, offsets: entry.Offsets, creation: entry.Creation, ttls: entry.TTLs})
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+// validOffsets checks that every TTL offset falls within data.
+func validOffsets(data []byte, offsets []int) bool {
+	if len(data) < DNSHeaderLength || len(offsets) == 0 {
+		return false
+	}
+
+	for _, offset := range offsets {
+		if offset < DNSHeaderLength || offset+4 > len(data) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Snapshotter ticks over and periodically saves the cache to path.
+func (qc *QueryCache) Snapshotter(path string) {
+	for {
+		time.Sleep(snapshotFrequency)
+
+		if err := qc.Save(path); err != nil {
+			qc.log.Warn("Error saving cache snapshot", "err", err, "path", path)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package veild
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQueryCache_Save_Load(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+	queryCache := NewQueryCache(newLogger(), 0, 0, 0)
+
+	live := newCachedQuery("live.com", 300)
+	live.creation = time.Now().Add(-time.Minute)
+	expired := newCachedQuery("expired.com", 60)
+	expired.creation = time.Now().Add(-2 * time.Minute)
+
+	queryCache.Set(live)
+	queryCache.Set(expired)
+
+	if err := queryCache.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewQueryCache(newLogger(), 0, 0, 0)
+	loaded, err := restored.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded != 1 {
+		t.Errorf("wanted 1 entry loaded got %d", loaded)
+	}
+
+	query, ok := restored.Get(live.cacheKey())
+	if !ok {
+		t.Fatal("expected live entry to be restored")
+	}
+
+	// TTLs carry on from where they were rather than starting again.
+	if ttl := query.ttl(); ttl > 240 {
+		t.Errorf("expected TTL to be decremented, got %d", ttl)
+	}
+
+	if _, ok := restored.Get(expired.cacheKey()); ok {
+		t.Error("expected expired entry to be discarded")
+	}
+}
+
+func TestQueryCache_Load_invalid(t *testing.T) {
+	queryCache := NewQueryCache(newLogger(), 0, 0, 0)
+	queryCache.Set(newCachedQuery("protonmail.com", 300))
+
+	path := filepath.Join(t.TempDir(), "cache.snapshot")
+	if err := queryCache.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, _ := os.ReadFile(path)
+
+	corrupt := bytes.Clone(snapshot)
+	corrupt[len(corrupt)-1] ^= 0xff
+
+	newVersion := bytes.Clone(snapshot)
+	binary.BigEndian.PutUint16(newVersion[len(snapshotMagic):], snapshotVersion+1)
+
+	cases := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"empty", nil, ErrInvalidSnapshot},
+		{"not a snapshot", []byte("example.com\n"), ErrInvalidSnapshot},
+		{"truncated", snapshot[:len(snapshot)/2], ErrInvalidSnapshot},
+		{"corrupt", corrupt, ErrInvalidSnapshot},
+		{"unsupported version", newVersion, ErrUnsupportedSnapshotVersion},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.snapshot")
+			os.WriteFile(path, c.data, 0o600)
+
+			restored := NewQueryCache(newLogger(), 0, 0, 0)
+			if _, err := restored.Load(path); !errors.Is(err, c.err) {
+				t.Errorf("wanted %v got %v", c.err, err)
+			}
+
+			if restored.lru.Len() != 0 {
+				t.Error("expected nothing to be loaded")
+			}
+		})
+	}
+}
@@ -2,20 +2,24 @@ package veild
 
 import (
 	"bytes"
+	"encoding/binary"
 	"os"
 	"testing"
 	"time"
 )
 
-func newQuery() *Query {
-	return &Query{
-		data: []byte{
-			0x53, 0x1, 0x1, 0x20, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0,
-			0x0, 0x1, 0xa, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x6e,
-			0x6d, 0x61, 0x69, 0x6c, 0x3, 0x63, 0x6f, 0x6d, 0x0,
-			0x0, 0x1, 0x0, 0x1, 0x0, 0x0, 0x29, 0x0, 0x32, 0x0,
-			0x0, 0x80, 0x0, 0x0, 0x0},
-	}
+// newCachedQuery returns a cacheable query with a single A record for host.
+func newCachedQuery(host string, ttl uint32) *Query {
+	response := newResponse(newTestQuery(host, 1), rcodeSuccess)
+	binary.BigEndian.PutUint16(response[6:8], 1)
+
+	// Owner name is a pointer to the question, followed by TYPE, CLASS, TTL and RDATA.
+	response = append(response, 0xc0, 0x0c, 0x0, 0x1, 0x0, 0x1)
+	response = binary.BigEndian.AppendUint32(response, ttl)
+	response = append(response, 0x0, 0x4, 127, 0, 0, 1)
+
+	offsets := recordTTLOffsets(response)
+	return &Query{data: response, offsets: offsets, creation: time.Now()}
 }
 
 func TestQueryCache_NewQueryCache(t *testing.T) {
@@ -25,8 +29,8 @@ func TestQueryCache_NewQueryCache(t *testing.T) {
 func TestQueryCache_Set(t *testing.T) {
 	logger := newLogger()
 
-	queryCache := NewQueryCache(logger)
-	v := newQuery()
+	queryCache := NewQueryCache(logger, 0, 0, 0)
+	v := newCachedQuery("protonmail.com", 300)
 	queryCache.Set(v)
 
 	queryCache.Get(v.cacheKey())
@@ -39,8 +43,8 @@ func TestQueryCache_Set(t *testing.T) {
 func TestQueryCache_Get(t *testing.T) {
 	logger := newLogger()
 
-	queryCache := NewQueryCache(logger)
-	v := newQuery()
+	queryCache := NewQueryCache(logger, 0, 0, 0)
+	v := newCachedQuery("protonmail.com", 300)
 	queryCache.Set(v)
 
 	queryCache.Get(v.cacheKey())
@@ -50,15 +54,53 @@ func TestQueryCache_Get(t *testing.T) {
 	}
 }
 
+func TestQueryCache_Get_clampedTTL(t *testing.T) {
+	tests := []struct {
+		name       string
+		rewriteTTL bool
+		want       uint32
+	}{
+		{name: "upstream TTL", want: 5},
+		{name: "rewritten TTL", rewriteTTL: true, want: 60},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config = &Config{MinTTL: time.Minute, RewriteTTL: test.rewriteTTL}
+
+			query, err := queryFromResponse(newCachedQuery("protonmail.com", 5).data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Cached for the clamped TTL either way.
+			query.creation = time.Now().Add(-10 * time.Second)
+
+			queryCache := NewQueryCache(newLogger(), 0, 0, 0)
+			queryCache.Set(query)
+
+			got, ok := queryCache.Get(query.cacheKey())
+			if !ok {
+				t.Fatal("expected entry to be cached for the clamped TTL")
+			}
+
+			want := test.want - min(test.want, 10)
+			if ttl := got.ttl(); ttl != want {
+				t.Errorf("wanted TTL of %d got %d", want, ttl)
+			}
+		})
+	}
+}
+
 func TestQueryCache_Entries(t *testing.T) {
 	file, _ := os.ReadFile("fixtures/phishing-detection.api.cx.metamask.io_a.pkt")
 	logger := newLogger()
 
-	queryCache := NewQueryCache(logger)
+	queryCache := NewQueryCache(logger, 0, 0, 0)
 	n := len(file)
 
-	offsets, _ := ttlOffsets(file[:n])
-	queryCache.Set(&Query{file[:n], offsets, time.Now()})
+	offsets := recordTTLOffsets(file[:n])
+	queryCache.Set(&Query{data: file[:n], offsets: offsets, creation: time.Now()})
 
 	var b bytes.Buffer
 	queryCache.Entries(&b)
@@ -74,10 +116,156 @@ func TestQueryCache_Reaper(t *testing.T) {
 	file, _ := os.ReadFile("fixtures/phishing-detection.api.cx.metamask.io_a.pkt")
 	logger := newLogger()
 
-	queryCache := NewQueryCache(logger)
+	queryCache := NewQueryCache(logger, 0, 0, 0)
 	n := len(file)
 
-	offsets, _ := ttlOffsets(file[:n])
-	queryCache.Set(&Query{file[:n], offsets, time.Now()})
+	offsets := recordTTLOffsets(file[:n])
+	queryCache.Set(&Query{data: file[:n], offsets: offsets, creation: time.Now()})
 	queryCache.reaper()
 }
+
+func TestQueryCache_evict_entries(t *testing.T) {
+	queryCache := NewQueryCache(newLogger(), 2, 0, 0)
+
+	first := newCachedQuery("first.com", 300)
+	second := newCachedQuery("second.com", 300)
+	third := newCachedQuery("third.com", 300)
+
+	queryCache.Set(first)
+	queryCache.Set(second)
+
+	// Touch the first entry so the second becomes the least recently used.
+	queryCache.Get(first.cacheKey())
+
+	queryCache.Set(third)
+
+	if _, ok := queryCache.Get(second.cacheKey()); ok {
+		t.Error("expected least recently used entry to be evicted")
+	}
+
+	for _, query := range []*Query{first, third} {
+		if _, ok := queryCache.Get(query.cacheKey()); !ok {
+			t.Error("expected recently used entries to remain")
+		}
+	}
+
+	if queryCache.evictions != 1 {
+		t.Errorf("wanted 1 eviction got %d", queryCache.evictions)
+	}
+}
+
+func TestQueryCache_evict_bytes(t *testing.T) {
+	first := newCachedQuery("first.com", 300)
+	second := newCachedQuery("second.com", 300)
+
+	// Only room for one of the entries.
+	queryCache := NewQueryCache(newLogger(), 0, second.size(), 0)
+
+	queryCache.Set(first)
+	queryCache.Set(second)
+
+	if _, ok := queryCache.Get(first.cacheKey()); ok {
+		t.Error("expected first entry to be evicted")
+	}
+
+	if queryCache.bytes != second.size() {
+		t.Errorf("wanted %d bytes got %d", second.size(), queryCache.bytes)
+	}
+}
+
+func TestQueryCache_Set_replace(t *testing.T) {
+	queryCache := NewQueryCache(newLogger(), 0, 0, 0)
+
+	v := newCachedQuery("protonmail.com", 300)
+	queryCache.Set(v)
+	queryCache.Set(newCachedQuery("protonmail.com", 300))
+
+	if queryCache.lru.Len() != 1 || queryCache.bytes != v.size() {
+		t.Errorf("expected replaced entry to be accounted for once, got %d entries and %d bytes", queryCache.lru.Len(), queryCache.bytes)
+	}
+}
+
+func TestQueryCache_Get_expired(t *testing.T) {
+	queryCache := NewQueryCache(newLogger(), 0, 0, time.Hour)
+
+	v := newCachedQuery("protonmail.com", 60)
+	v.creation = time.Now().Add(-2 * time.Minute)
+	queryCache.Set(v)
+
+	if _, ok := queryCache.Get(v.cacheKey()); ok {
+		t.Error("expected expired entry not to be returned")
+	}
+
+	stale, ok := queryCache.GetStale(v.cacheKey())
+	if !ok {
+		t.Fatal("expected expired entry to be served stale")
+	}
+
+	if got := stale.ttl(); got != staleTTL {
+		t.Errorf("wanted stale TTL of %d got %d", staleTTL, got)
+	}
+}
+
+func TestQueryCache_GetStale_outside_window(t *testing.T) {
+	queryCache := NewQueryCache(newLogger(), 0, 0, time.Minute)
+
+	v := newCachedQuery("protonmail.com", 60)
+	v.creation = time.Now().Add(-5 * time.Minute)
+	queryCache.Set(v)
+
+	if _, ok := queryCache.GetStale(v.cacheKey()); ok {
+		t.Error("expected entry outside the stale window not to be served")
+	}
+
+	queryCache.reaper()
+
+	if queryCache.lru.Len() != 0 {
+		t.Error("expected reaper to remove entry outside the stale window")
+	}
+}
+
+func TestQueryCache_Prefetch(t *testing.T) {
+	config = &Config{PrefetchHits: 2, PrefetchThreshold: 0.5, PrefetchRate: 1}
+	queryCache := NewQueryCache(newLogger(), 0, 0, 0)
+
+	fresh := newCachedQuery("fresh.com", 60)
+	first := newCachedQuery("first.com", 60)
+	second := newCachedQuery("second.com", 60)
+
+	// Both within half of their TTL.
+	first.creation = time.Now().Add(-40 * time.Second)
+	second.creation = time.Now().Add(-40 * time.Second)
+
+	for _, query := range []*Query{fresh, first, second} {
+		queryCache.Set(query)
+		queryCache.Get(query.cacheKey())
+	}
+
+	if queryCache.Prefetch(first.cacheKey()) {
+		t.Error("expected entry without enough hits not to be prefetched")
+	}
+
+	for _, query := range []*Query{fresh, first, second} {
+		queryCache.Get(query.cacheKey())
+	}
+
+	if queryCache.Prefetch(fresh.cacheKey()) {
+		t.Error("expected entry with plenty of TTL left not to be prefetched")
+	}
+
+	if !queryCache.Prefetch(first.cacheKey()) {
+		t.Error("expected popular entry close to expiring to be prefetched")
+	}
+
+	if queryCache.Prefetch(first.cacheKey()) {
+		t.Error("expected entry to only be prefetched once")
+	}
+
+	if queryCache.Prefetch(second.cacheKey()) {
+		t.Error("expected prefetches to be rate limited")
+	}
+
+	if queryCache.prefetches != 1 {
+		t.Errorf("wanted 1 prefetch got %d", queryCache.prefetches)
+	}
+}
@@ -5,15 +5,31 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
 )
 
+// recordTTLOffsets returns the offsets of the TTLs of the answer and authority
+// records in data.
+func recordTTLOffsets(data []byte) []int {
+	msg, err := parseMessage(data)
+	if err != nil {
+		return nil
+	}
+
+	var offsets []int
+	for _, rr := range append(msg.answers, msg.authority...) {
+		offsets = append(offsets, rr.ttl)
+	}
+	return offsets
+}
+
 func TestQuery_cacheKey(t *testing.T) {
 	t.Skip()
 }
 
 func TestQuery_decTTL(t *testing.T) {
 	file, _ := os.ReadFile("fixtures/client.dropbox.com_aaaa.pkt")
-	offsets, _ := ttlOffsets(file)
+	offsets := recordTTLOffsets(file)
 
 	originalTtls := []uint32{}
 
@@ -38,7 +54,7 @@ func TestQuery_decTTL(t *testing.T) {
 
 func TestQuery_getTTLs(t *testing.T) {
 	file, _ := os.ReadFile("fixtures/client.dropbox.com_aaaa.pkt")
-	offsets, _ := ttlOffsets(file)
+	offsets := recordTTLOffsets(file)
 
 	query := Query{data: file, offsets: offsets}
 	got := query.getTTLs()
@@ -48,3 +64,165 @@ func TestQuery_getTTLs(t *testing.T) {
 		t.Errorf("wanted %v got %v", want, got)
 	}
 }
+
+// newNegativeResponse forms a response for example.com with an SOA record
+// in the authority section.
+func newNegativeResponse(rc int, soaTTL, minimum uint32) []byte {
+	response := newResponse(newTestQuery("example.com", 1), rc)
+	binary.BigEndian.PutUint16(response[8:10], 1)
+
+	// Owner name is a pointer to the question, followed by TYPE, CLASS and TTL.
+	response = append(response, 0xc0, 0x0c, 0x0, 0x6, 0x0, 0x1)
+	response = binary.BigEndian.AppendUint32(response, soaTTL)
+
+	// RDATA is MNAME and RNAME (both root here), SERIAL, REFRESH, RETRY, EXPIRE and MINIMUM.
+	response = binary.BigEndian.AppendUint16(response, 22)
+	response = append(response, 0x0, 0x0)
+	for _, field := range []uint32{1, 7200, 3600, 1209600, minimum} {
+		response = binary.BigEndian.AppendUint32(response, field)
+	}
+
+	return response
+}
+
+func TestQuery_queryFromResponse(t *testing.T) {
+	config = &Config{}
+
+	positive, _ := os.ReadFile("fixtures/phishing-detection.api.cx.metamask.io_a.pkt")
+	wantOffsets := []int{61, 128, 186, 213, 251, 307, 321}
+
+	query, err := queryFromResponse(positive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(query.offsets, wantOffsets) {
+		t.Errorf("wanted offsets %v got %v", wantOffsets, query.offsets)
+	}
+}
+
+func TestQuery_queryFromResponse_negative(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		maxTTL   time.Duration
+		want     []uint32
+		err      error
+	}{
+		{
+			name:     "NXDOMAIN uses SOA MINIMUM",
+			response: newNegativeResponse(rcodeNXDomain, 3600, 300),
+			want:     []uint32{300},
+		},
+		{
+			name:     "NXDOMAIN uses SOA TTL",
+			response: newNegativeResponse(rcodeNXDomain, 60, 300),
+			want:     []uint32{60},
+		},
+		{
+			name:     "NXDOMAIN capped",
+			response: newNegativeResponse(rcodeNXDomain, 3600, 300),
+			maxTTL:   time.Minute,
+			want:     []uint32{60},
+		},
+		{
+			name:     "NODATA",
+			response: newNegativeResponse(rcodeSuccess, 3600, 900),
+			want:     []uint32{900},
+		},
+		{
+			name:     "NXDOMAIN without SOA",
+			response: newResponse(newTestQuery("example.com", 1), rcodeNXDomain),
+			err:      ErrNotCacheable,
+		},
+		{
+			name:     "SERVFAIL",
+			response: newNegativeResponse(rcodeServFail, 3600, 300),
+			err:      ErrNotCacheable,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config = &Config{MaxNegativeTTL: test.maxTTL}
+
+			query, err := queryFromResponse(test.response)
+			if err != test.err {
+				t.Fatalf("wanted error %v got %v", test.err, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if got := query.getTTLs(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wanted TTLs %v got %v", test.want, got)
+			}
+
+			if rcode(query.data) != rcode(test.response) {
+				t.Errorf("expected rcode to be preserved")
+			}
+		})
+	}
+}
+
+func TestQuery_queryFromResponse_clamped(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		min, max time.Duration
+		maxNeg   time.Duration
+		want     []uint32
+	}{
+		{
+			name:     "unclamped",
+			response: newCachedQuery("example.com", 5).data,
+			want:     []uint32{5},
+		},
+		{
+			name:     "raised to minimum",
+			response: newCachedQuery("example.com", 5).data,
+			min:      time.Minute,
+			want:     []uint32{60},
+		},
+		{
+			name:     "lowered to maximum",
+			response: newCachedQuery("example.com", 604800).data,
+			max:      time.Hour,
+			want:     []uint32{3600},
+		},
+		{
+			name:     "negative ignores maximum",
+			response: newNegativeResponse(rcodeNXDomain, 3600, 900),
+			max:      time.Minute,
+			want:     []uint32{900},
+		},
+		{
+			name:     "negative raised to minimum",
+			response: newNegativeResponse(rcodeNXDomain, 3600, 0),
+			min:      time.Minute,
+			want:     []uint32{60},
+		},
+		{
+			name:     "negative maximum over minimum",
+			response: newNegativeResponse(rcodeNXDomain, 3600, 3600),
+			min:      time.Hour,
+			maxNeg:   5 * time.Minute,
+			want:     []uint32{300},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{MinTTL: tt.min, MaxTTL: tt.max, MaxNegativeTTL: tt.maxNeg}
+
+			query, err := queryFromResponse(tt.response)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := query.getTTLs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("wanted TTLs %v got %v", tt.want, got)
+			}
+		})
+	}
+}
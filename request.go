@@ -1,24 +1,145 @@
 package veild
 
 import (
+	"errors"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
+// ErrResponseDropped is returned when a response can't be handed back
+// because one has already been given.
+var ErrResponseDropped = errors.New("response dropped")
+
 // Request represents the structure of a client request.
 type Request struct {
-	clientAddr *net.UDPAddr
+	clientAddr net.Addr
 	clientConn RequestConn
 	data       []byte
 	start      time.Time
+
+	// maxSize is the largest response the client can accept over
+	// the transport the request arrived on.
+	maxSize int
+
+	// edns is the client's OPT record, nil if they didn't send one.
+	edns *EDNS
+
+	// retries is the number of times the request has been retried upstream
+	// and exclude is the resolver it should avoid on the next attempt.
+	retries int
+	exclude *Resolver
+
+	// background requests (e.g. cache refreshes) have no client waiting on them.
+	background bool
+
+	// rewritten requests are for the target of a rewrite rule.
+	rewritten bool
+
+	// pool is the pool the request was last queued on.
+	pool *Pool
+
+	// answered is set once a response has been written, e.g. a stale answer
+	// while the request is still waiting on upstream. Later responses are
+	// dropped.
+	answered atomic.Bool
 }
 
-func (r *Request) cacheKey() cacheKey {
-	return createCacheKey(r.data[:2])
+// write sends a response back to the client using the connection the
+// request arrived on, if it hasn't been answered already. The response's
+// OPT record is rewritten to match what the client sent and responses
+// larger than the client can accept are truncated.
+func (r *Request) write(b []byte) (int, error) {
+	if !r.answered.CompareAndSwap(false, true) {
+		return 0, ErrResponseDropped
+	}
+
+	edns := r.responseEDNS(b)
+	b = setEDNS(b, edns)
+
+	if r.maxSize > 0 && len(b) > r.maxSize {
+		b = setEDNS(truncate(b), edns)
+	}
+
+	return r.clientConn.WriteTo(b, r.clientAddr)
 }
 
-// RequestConn is an interface for writing to UDP connections.
+// responseEDNS returns the OPT record to send back to the client for a response.
+// Clients which didn't send an OPT record mustn't receive one.
+// SEE: https://datatracker.ietf.org/doc/html/rfc6891#section-7
+func (r *Request) responseEDNS(response []byte) *EDNS {
+	if r.edns == nil {
+		return nil
+	}
+
+	edns := &EDNS{
+		udpSize: ednsUDPSize,
+		do:      r.edns.do,
+	}
+
+	// Keep the extended RCODE and any options from upstream, apart from
+	// those which only make sense between upstream and veild.
+	if upstream, err := parseEDNS(response); err == nil && upstream != nil {
+		edns.extRCode = upstream.extRCode
+		edns.options = upstream.withoutOptions(ednsOptionCookie, ednsOptionPadding)
+	}
+
+	return edns
+}
+
+// upstreamData returns the request as it should be sent upstream. The client's
+// UDP payload size and cookies only apply between the client and veild, so the
+// OPT record is rewritten with our own.
+func (r *Request) upstreamData() []byte {
+	if r.edns == nil {
+		return r.data
+	}
+
+	return setEDNS(r.data, &EDNS{
+		udpSize: ednsUDPSize,
+		do:      r.edns.do,
+		options: r.edns.withoutOptions(ednsOptionCookie, ednsOptionPadding),
+	})
+}
+
+// RequestConn is an interface for writing responses back to clients.
+// UDP connections satisfy this directly, stream based connections (TCP)
+// are wrapped in a [streamConn].
 type RequestConn interface {
-	WriteToUDP([]byte, *net.UDPAddr) (int, error)
-	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo([]byte, net.Addr) (int, error)
+}
+
+// chanConn is a RequestConn which hands the response back over a channel,
+// for transports which answer synchronously (e.g. DoH).
+type chanConn chan []byte
+
+// WriteTo passes the response to whoever is waiting on the channel.
+func (c chanConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	select {
+	case c <- b:
+		return len(b), nil
+	default:
+		return 0, ErrResponseDropped
+	}
+}
+
+// newBackgroundRequest returns a copy of r which refreshes the cache without
+// answering the client.
+func newBackgroundRequest(r *Request) *Request {
+	return &Request{
+		clientConn: discardConn{},
+		data:       r.data,
+		start:      time.Now(),
+		edns:       r.edns,
+		background: true,
+	}
+}
+
+// discardConn is a RequestConn for background requests, responses are only
+// used to populate the cache.
+type discardConn struct{}
+
+// WriteTo discards the response.
+func (discardConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	return len(b), nil
 }
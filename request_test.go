@@ -1,9 +1,93 @@
 package veild
 
 import (
+	"encoding/binary"
+	"net"
+	"os"
+	"reflect"
 	"testing"
 )
 
-func TestRequest_cacheKey(t *testing.T) {
-	t.Skip()
+// captureConn is a RequestConn which records what was written to it.
+type captureConn struct {
+	written []byte
+}
+
+func (c *captureConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.written = b
+	return len(b), nil
+}
+
+func TestRequest_write(t *testing.T) {
+	response, _ := os.ReadFile("fixtures/phishing-detection.api.cx.metamask.io_a.pkt")
+
+	tests := []struct {
+		name      string
+		maxSize   int
+		truncated bool
+	}{
+		{"fits", 512, false},
+		{"too large", 256, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &captureConn{}
+			request := &Request{clientConn: conn, maxSize: test.maxSize}
+			request.write(response)
+
+			truncated := binary.BigEndian.Uint16(conn.written[2:4])&flagTC != 0
+			if truncated != test.truncated {
+				t.Errorf("wanted truncated %v got %v", test.truncated, truncated)
+			}
+			if len(conn.written) > test.maxSize {
+				t.Errorf("response of %d bytes exceeds %d", len(conn.written), test.maxSize)
+			}
+		})
+	}
+}
+
+func TestRequest_write_edns(t *testing.T) {
+	response, _ := os.ReadFile("fixtures/response_protonmail.com_a.pkt")
+
+	tests := []struct {
+		name string
+		edns *EDNS
+		want *EDNS
+	}{
+		{"client without OPT", nil, nil},
+		{"client with OPT", &EDNS{udpSize: 4096, do: true}, &EDNS{udpSize: ednsUDPSize, do: true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &captureConn{}
+			request := &Request{clientConn: conn, edns: test.edns}
+			request.write(response)
+
+			got, err := parseEDNS(conn.written)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("wanted %+v got %+v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestRequest_upstreamData(t *testing.T) {
+	query, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+
+	request := &Request{
+		data: query,
+		edns: &EDNS{udpSize: 4096, options: []EDNSOption{{code: ednsOptionCookie, data: []byte{0x1}}}},
+	}
+
+	got, _ := parseEDNS(request.upstreamData())
+	want := &EDNS{udpSize: ednsUDPSize}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("wanted %+v got %+v", want, got)
+	}
 }
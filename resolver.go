@@ -1,24 +1,24 @@
 package veild
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"slices"
 	"sync"
 	"time"
 )
 
-// ResponsePacketLength represents the buff size for the response packet.
-const ResponsePacketLength = 2048
-
 // Resolver represents an upstream DNS resolver.
 type Resolver struct {
 	resolver ResolverEntry
 	writeCh  chan *Request
 	closeCh  chan struct{}
-	doneCh   chan struct{}
 	conn     io.ReadWriteCloser
+	dialer   ResolverDialer
 	cache    *ResponseCache
 	log      *slog.Logger
 
@@ -27,17 +27,41 @@ type Resolver struct {
 	lastReq time.Time
 }
 
+// ResolverDialer dials connections to upstream resolvers. Connections read and
+// write length prefixed DNS messages, as per DNS over TCP, regardless of the
+// underlying transport.
 type ResolverDialer interface {
 	DialConn(ResolverEntry) (io.ReadWriteCloser, error)
 }
 
+// newResolverDialer returns the dialer for a resolver's transport.
+func newResolverDialer(re ResolverEntry, logger *slog.Logger) ResolverDialer {
+	switch {
+	case re.URL != "":
+		return HTTPSResolverDialer{log: logger.With("module", "doh")}
+	case re.Protocol == protocolTCP:
+		return TCPResolverDialer{}
+	case re.Protocol == protocolUDP:
+		return UDPResolverDialer{log: logger.With("module", "udp")}
+	}
+	return TLSResolverDialer{}
+}
+
+// ErrResolverStopped is returned when a resolver is removed while connecting.
+var ErrResolverStopped = errors.New("resolver stopped")
+
 // NewResolver creates a new Resolver which is an actual connection to an upstream DNS server.
 func NewResolver(rc *ResponseCache, re ResolverEntry, rd ResolverDialer, logger *slog.Logger) (*Resolver, error) {
+	return newResolver(rc, re, rd, nil, logger)
+}
+
+// newResolver creates a new Resolver, giving up on connecting once stop is closed.
+func newResolver(rc *ResponseCache, re ResolverEntry, rd ResolverDialer, stop <-chan struct{}, logger *slog.Logger) (*Resolver, error) {
 	rs := &Resolver{
 		resolver: re,
 		writeCh:  make(chan *Request, 1),
 		closeCh:  make(chan struct{}),
-		doneCh:   make(chan struct{}),
+		dialer:   rd,
 		cache:    rc,
 		start:    time.Now(),
 		lastReq:  time.Now(),
@@ -57,9 +81,16 @@ retry:
 	conn, err := rd.DialConn(re)
 	rs.log.Debug("Dial complete", "host", rs.resolver.Address)
 	if err != nil {
-		rs.log.Warn("Failed to connect", "host", rs.resolver.Address, "reconnecting_in", t*time.Second)
+		if errors.Is(err, ErrPinMismatch) {
+			rs.log.Error("Rejected connection, certificate doesn't match pin", "host", rs.resolver.Address, "hostname", rs.resolver.Hostname)
+		}
+		rs.log.Warn("Failed to connect", "host", rs.resolver.Address, "err", err, "reconnecting_in", t*time.Second)
 		// Back off for t seconds (exponential backoff).
-		time.Sleep(t * time.Second)
+		select {
+		case <-time.After(t * time.Second):
+		case <-stop:
+			return nil, ErrResolverStopped
+		}
 		t = t << 1
 		goto retry
 	}
@@ -87,58 +118,73 @@ func (rs *Resolver) readLoop() {
 		close(rs.closeCh)
 	}()
 
+	reader := bufio.NewReader(rs.conn)
+
 	for {
 		rs.log.Debug("Reading from upstream DNS server...", "host", rs.resolver.Address)
 
-		buff := make([]byte, ResponsePacketLength)
-		n, err := rs.conn.Read(buff)
-
+		// Read the length prefixed response.
+		// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
+		buff, err := readMessage(reader)
 		if err != nil {
 			rs.log.Debug("Connection gone away", "host", rs.resolver.Address, "err", err)
 			return
 		}
 
-		// Discard first 2 bytes (packet length) and truncate to length of received bytes
-		// as we're returning this over UDP to the client.
-		// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
-		buff = buff[2:n]
+		if len(buff) < DNSHeaderLength {
+			rs.log.Warn("Response length too small", "host", rs.resolver.Address, "length", len(buff))
+			continue
+		}
 
-		trxID := buff[:2]
-		key := createCacheKey(trxID)
+		trxID := fmt.Sprintf("0x%x", buff[:2])
 
-		if request, ok := rs.cache.Get(key); ok {
+		if request, ok := rs.cache.Match(buff); ok {
 
-			rs.cache.log.Debug("Match request cache", "trx_id", fmt.Sprintf("0x%x", trxID))
+			rs.cache.log.Debug("Match request cache", "trx_id", trxID)
 
-			if config.CachingEnabled {
-				offsets, err := ttlOffsets(buff)
-				if err != nil {
-					rs.cache.log.Warn("Error parsing offsets", "err", err)
-					continue
+			// Restore the client's transaction ID.
+			copy(buff[:2], request.data[:2])
+
+			// Prefer a stale answer over passing on a failure.
+			if rcode(buff) == rcodeServFail && serveStaleAndRefresh(request.pool, request) {
+				continue
+			}
+
+			// Pass on the clamped TTLs rather than what upstream gave us.
+			if config.RewriteTTL {
+				if msg, err := parseMessage(buff); err == nil {
+					clampTTLs(buff, msg)
 				}
+			}
 
-				// Only cache if there are TTLs to decrement otherwise the cache will
-				// get filled with entries that can't be evicted.
-				if len(offsets) > 0 {
-					queryCache.Set(&Query{buff, offsets, time.Now()})
+			if config.CachingEnabled {
+				query, err := queryFromResponse(buff)
+				if err == nil {
+					queryCache.Set(query)
+				} else {
+					rs.cache.log.Debug("Not caching response", "err", err)
 				}
 			}
 
-			// Write back to client over UDP.
-			_, err = request.clientConn.WriteToUDP(buff, request.clientAddr)
+			// Write back to the client.
+			n, err := request.write(buff)
+			if errors.Is(err, ErrResponseDropped) {
+				rs.log.Debug("Client already answered, response only cached", "trx_id", trxID)
+				continue
+			}
 			if err != nil {
 				rs.log.Warn("Error writing back to client", "err", err, "client_ip", request.clientAddr)
-				break
+				continue
 			}
 			rs.log.Debug("Wrote bytes back to client", "bytes", n)
 
 			// Calculate ellapsed time since start of request.
 			elapsed := time.Since(request.start)
 
-			rs.log.Info("Processed request", "trx_id", fmt.Sprintf("0x%x", trxID), "elapsed", elapsed, "context", "pool")
+			rs.log.Info("Processed request", "trx_id", trxID, "client_trx_id", fmt.Sprintf("0x%x", buff[:2]), "elapsed", elapsed, "context", "pool")
 
 		} else {
-			rs.log.Warn("No matching request in cache", "trx_id", fmt.Sprintf("0x%x", trxID))
+			rs.log.Warn("No matching request in cache", "trx_id", trxID)
 		}
 	}
 
@@ -166,25 +212,29 @@ func (rs *Resolver) writeLoop() {
 			rs.lastReq = time.Now()
 			rs.mu.Unlock()
 
-			// Calculate packet length and pack into uint16 (BigEndian).
-			// Because we're writing this out over TCP we need to prepend the length.
-			// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
-			packetLength := make([]byte, 2)
-			binary.BigEndian.PutUint16(packetLength, uint16(len(request.data)))
+			// Add to cache under our own transaction ID, before writing so
+			// that it's there when the response comes back.
+			id, err := rs.cache.Add(request)
+			if err != nil {
+				rs.log.Warn("Error adding request to cache", "host", rs.resolver.Address, "err", err)
+				request.write(newResponse(request.data, rcodeServFail))
+				continue
+			}
 
-			rs.log.Debug("Writing request to upstream DNS server", "host", rs.resolver.Address)
+			data := slices.Clone(request.upstreamData())
+			binary.BigEndian.PutUint16(data[:2], id)
+
+			rs.log.Debug("Writing request to upstream DNS server", "host", rs.resolver.Address, "trx_id", fmt.Sprintf("0x%x", data[:2]))
 
 			// Prepend packet length as this is over TCP.
-			n, err := rs.conn.Write(append(packetLength, request.data...))
+			// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
+			n, err := rs.conn.Write(packMessage(data))
 			if err != nil {
 				rs.log.Warn("Error passing request to upstream", "host", rs.resolver.Address, "err", err)
 				return
 			}
 			rs.log.Debug("Wrote bytes to server", "host", rs.resolver.Address, "bytes", n)
 
-			// Add to cache.
-			rs.cache.Set(request)
-
 		case <-rs.closeCh:
 			rs.log.Debug("Connection closed", "host", rs.resolver.Address)
 			return
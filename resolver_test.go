@@ -22,7 +22,7 @@ func NewMockClientConn() *MockClientConn {
 	}
 }
 
-func (m MockClientConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+func (m MockClientConn) WriteTo(b []byte, addr net.Addr) (int, error) {
 	// Block until we're told to continue by read.
 	<-m.readBlockerCh
 
@@ -104,7 +104,7 @@ func TestResolver_NewResolver(t *testing.T) {
 	// Setup.
 	logger := newLogger()
 	// TODO: We're using a global query cache which isn't right.
-	queryCache = NewQueryCache(logger)
+	queryCache = NewQueryCache(logger, 0, 0, 0)
 	rc := NewResponseCache(logger)
 	re := ResolverEntry{Hostname: "dns.quad9.net", Address: "9.9.9.9:853"}
 
@@ -135,7 +135,7 @@ func TestResolver_NewResolver(t *testing.T) {
 	}
 
 	// Read the response.
-	b := make([]byte, ResponsePacketLength)
+	b := make([]byte, maxMessageLength)
 	n, _, _ := clientConn.ReadFrom(b)
 	rawPacketResponse, _ := os.ReadFile("fixtures/response_protonmail.com_a.pkt")
 	if !bytes.Equal(b[:n], rawPacketResponse) {
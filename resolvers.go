@@ -1,8 +1,14 @@
 package veild
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -21,17 +27,74 @@ type ResolverEntry struct {
 	Address  string
 	Hostname string
 	Hash     string
-	Pin      string
+	Pin      PinSet
+
+	// PinOnly skips WebPKI verification of pinned resolvers.
+	PinOnly bool `yaml:"pin-only"`
+
+	// URL is the DNS-over-HTTPS endpoint, if set the resolver is used over
+	// DoH rather than DoT. Method is either GET or POST (the default).
+	URL    string
+	Method string
+
+	// Protocol is one of tls (the default), tcp or udp. Plain tcp and udp are
+	// for local and internal resolvers which don't support encryption.
+	Protocol string
+}
+
+// Upstream protocols.
+const (
+	protocolTLS = "tls"
+	protocolTCP = "tcp"
+	protocolUDP = "udp"
+)
+
+// PinSet is a set of base64 encoded SHA-256 SPKI fingerprints. In the resolvers
+// file it can be given as a single pin or a list of pins to allow for rotation.
+type PinSet []string
+
+// UnmarshalYAML handles both the single pin and list forms of a PinSet.
+func (p *PinSet) UnmarshalYAML(unmarshal func(any) error) error {
+	var pin string
+	if err := unmarshal(&pin); err == nil {
+		*p = nil
+		if pin != "" {
+			*p = PinSet{pin}
+		}
+		return nil
+	}
+
+	var pins []string
+	if err := unmarshal(&pins); err != nil {
+		return err
+	}
+	*p = pins
+
+	return nil
+}
+
+// ForwarderEntry sends queries for a set of domains, and their subdomains, to
+// its own resolvers rather than the default ones.
+type ForwarderEntry struct {
+	Name      string
+	Domains   []string
+	Resolvers []ResolverEntry
 }
 
 // Resolvers implements a list of resolvers.
 type Resolvers struct {
-	Resolvers []ResolverEntry
+	Resolvers  []ResolverEntry
+	Forwarders []ForwarderEntry
 }
 
 var (
 	ErrReadingResolversFile   = errors.New("reading resolvers file")
 	ErrUnmarshallingResolvers = errors.New("error unmarshalling resolvers file")
+	ErrInvalidPin             = errors.New("invalid resolver pin")
+	ErrInvalidURL             = errors.New("invalid resolver url")
+	ErrInvalidProtocol        = errors.New("invalid resolver protocol")
+	ErrNoResolvers            = errors.New("no resolvers configured")
+	ErrInvalidForwarder       = errors.New("invalid forwarder")
 )
 
 // NewResolvers loads of a list of resolvers from a file.
@@ -51,5 +114,154 @@ func NewResolvers(resolversPath string) (*Resolvers, error) {
 		return nil, errors.Join(ErrUnmarshallingResolvers, err)
 	}
 
+	if err := validateResolvers(resolvers.Resolvers); err != nil {
+		return nil, err
+	}
+
+	for _, forwarder := range resolvers.Forwarders {
+		if err := validateResolvers(forwarder.Resolvers); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateForwarders(resolvers.Forwarders); err != nil {
+		return nil, errors.Join(ErrInvalidForwarder, err)
+	}
+
 	return resolvers, nil
 }
+
+// validateResolvers checks each resolver's pins and URL.
+func validateResolvers(resolvers []ResolverEntry) error {
+	for i, resolver := range resolvers {
+		if err := resolver.validatePins(); err != nil {
+			return errors.Join(ErrInvalidPin, err)
+		}
+		if err := resolvers[i].parseURL(); err != nil {
+			return errors.Join(ErrInvalidURL, err)
+		}
+		if err := resolver.validateProtocol(); err != nil {
+			return errors.Join(ErrInvalidProtocol, err)
+		}
+	}
+
+	return nil
+}
+
+// validateForwarders checks each forwarder has valid domains and at least one
+// resolver. Names default to the first domain and, like the domains, must be
+// unique.
+func validateForwarders(forwarders []ForwarderEntry) error {
+	names := make(map[string]struct{}, len(forwarders))
+	domains := &domainTrie[struct{}]{}
+
+	for i := range forwarders {
+		forwarder := &forwarders[i]
+
+		if len(forwarder.Domains) == 0 {
+			return fmt.Errorf("forwarder %d: missing domains", i+1)
+		}
+
+		if forwarder.Name == "" {
+			forwarder.Name = normalizeDomain(forwarder.Domains[0])
+		}
+
+		if _, ok := names[forwarder.Name]; ok {
+			return fmt.Errorf("%s: duplicate name", forwarder.Name)
+		}
+		names[forwarder.Name] = struct{}{}
+
+		if len(forwarder.Resolvers) == 0 {
+			return fmt.Errorf("%s: missing resolvers", forwarder.Name)
+		}
+
+		for _, domain := range forwarder.Domains {
+			size := domains.Len()
+			if !domains.Insert(domain, struct{}{}) {
+				return fmt.Errorf("%s: invalid domain %q", forwarder.Name, domain)
+			}
+			if domains.Len() == size {
+				return fmt.Errorf("%s: duplicate domain %q", forwarder.Name, domain)
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseURL validates a DoH resolver's URL and defaults the address and
+// hostname from it if they're not given.
+func (re *ResolverEntry) parseURL() error {
+	if re.URL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(re.URL)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "https" {
+		return fmt.Errorf("%s: scheme must be https", re.URL)
+	}
+
+	if re.Method != "" && re.Method != http.MethodGet && re.Method != http.MethodPost {
+		return fmt.Errorf("%s: unsupported method %q", re.URL, re.Method)
+	}
+
+	if re.Hostname == "" {
+		re.Hostname = u.Hostname()
+	}
+
+	if re.Address == "" {
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		re.Address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	return nil
+}
+
+// validateProtocol checks a resolver's protocol is one we support and makes
+// sense with the rest of its settings.
+func (re ResolverEntry) validateProtocol() error {
+	switch re.Protocol {
+	case "", protocolTLS:
+		return nil
+	case protocolTCP, protocolUDP:
+	default:
+		return fmt.Errorf("%s: unsupported protocol %q", re.Address, re.Protocol)
+	}
+
+	if re.URL != "" {
+		return fmt.Errorf("%s: protocol %s can't be used with a url", re.Address, re.Protocol)
+	}
+
+	if len(re.Pin) > 0 {
+		return fmt.Errorf("%s: pins require tls", re.Address)
+	}
+
+	return nil
+}
+
+// validatePins checks that a resolver's pins are SHA-256 digests.
+func (re ResolverEntry) validatePins() error {
+	if re.PinOnly && len(re.Pin) == 0 {
+		return fmt.Errorf("%s: pin-only requires at least one pin", re.Address)
+	}
+
+	if len(re.Pin) > 0 && re.Hash != "" && !strings.EqualFold(re.Hash, "sha256") {
+		return fmt.Errorf("%s: unsupported pin hash %q", re.Address, re.Hash)
+	}
+
+	for _, pin := range re.Pin {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != 32 {
+			return fmt.Errorf("%s: pin %q is not a base64 encoded SHA-256 digest", re.Address, pin)
+		}
+	}
+
+	return nil
+}
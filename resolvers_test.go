@@ -21,6 +21,31 @@ func TestResolvers_NewResolvers(t *testing.T) {
 			filename: "fixtures/test_malformed_resolvers.yml",
 			want:     ErrUnmarshallingResolvers,
 		},
+		{
+			name:     "handle pinned resolvers",
+			filename: "fixtures/test_pinned_resolvers.yml",
+			want:     nil,
+		},
+		{
+			name:     "handle invalid pin",
+			filename: "fixtures/test_invalid_pin_resolvers.yml",
+			want:     ErrInvalidPin,
+		},
+		{
+			name:     "handle DoH resolvers",
+			filename: "fixtures/test_doh_resolvers.yml",
+			want:     nil,
+		},
+		{
+			name:     "handle forwarders",
+			filename: "fixtures/test_forwarder_resolvers.yml",
+			want:     nil,
+		},
+		{
+			name:     "handle invalid forwarders",
+			filename: "fixtures/test_invalid_forwarder_resolvers.yml",
+			want:     ErrInvalidForwarder,
+		},
 		{
 			name:     "handle non-existent file",
 			filename: "non-existent file",
@@ -37,3 +62,121 @@ func TestResolvers_NewResolvers(t *testing.T) {
 		})
 	}
 }
+
+func TestResolvers_NewResolvers_pinSet(t *testing.T) {
+	resolvers, err := NewResolvers("fixtures/test_pinned_resolvers.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(resolvers.Resolvers[0].Pin); got != 1 {
+		t.Errorf("wanted 1 pin got %d", got)
+	}
+
+	if got := len(resolvers.Resolvers[1].Pin); got != 2 {
+		t.Errorf("wanted 2 pins got %d", got)
+	}
+
+	if !resolvers.Resolvers[1].PinOnly {
+		t.Error("expected pin-only to be set")
+	}
+}
+
+func TestResolvers_NewResolvers_url(t *testing.T) {
+	resolvers, err := NewResolvers("fixtures/test_doh_resolvers.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address  string
+		hostname string
+	}{
+		{"9.9.9.9:443", "dns.quad9.net"},
+		{"all.dns.mullvad.net:443", "all.dns.mullvad.net"},
+	}
+
+	for i, test := range tests {
+		re := resolvers.Resolvers[i]
+		if re.Address != test.address || re.Hostname != test.hostname {
+			t.Errorf("wanted %s (%s) got %s (%s)", test.address, test.hostname, re.Address, re.Hostname)
+		}
+	}
+}
+
+func TestResolvers_validateForwarders(t *testing.T) {
+	resolvers := []ResolverEntry{{Address: "10.0.0.53:853"}}
+
+	tests := []struct {
+		name       string
+		forwarders []ForwarderEntry
+		valid      bool
+	}{
+		{"valid", []ForwarderEntry{{Domains: []string{"corp.example.com"}, Resolvers: resolvers}}, true},
+		{"missing domains", []ForwarderEntry{{Name: "corp", Resolvers: resolvers}}, false},
+		{"missing resolvers", []ForwarderEntry{{Domains: []string{"corp.example.com"}}}, false},
+		{"invalid domain", []ForwarderEntry{{Domains: []string{"corp..example.com"}, Resolvers: resolvers}}, false},
+		{"duplicate name", []ForwarderEntry{
+			{Name: "corp", Domains: []string{"corp.example.com"}, Resolvers: resolvers},
+			{Name: "corp", Domains: []string{"10.in-addr.arpa"}, Resolvers: resolvers},
+		}, false},
+		{"duplicate domain", []ForwarderEntry{
+			{Domains: []string{"corp.example.com"}, Resolvers: resolvers},
+			{Name: "lab", Domains: []string{"corp.example.com."}, Resolvers: resolvers},
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateForwarders(tt.forwarders); (err == nil) != tt.valid {
+				t.Errorf("wanted valid %v got %v", tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestResolvers_NewResolvers_forwarders(t *testing.T) {
+	resolvers, err := NewResolvers("fixtures/test_forwarder_resolvers.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := len(resolvers.Forwarders); got != 2 {
+		t.Fatalf("wanted 2 forwarders got %d", got)
+	}
+
+	if got := resolvers.Forwarders[1].Name; got != "home.arpa" {
+		t.Errorf("wanted name to default to the first domain, got %q", got)
+	}
+
+	// Forwarders' resolvers are validated like any other.
+	if got := resolvers.Forwarders[1].Resolvers[0].Address; got != "dns.home.arpa:443" {
+		t.Errorf("wanted address from the URL got %q", got)
+	}
+}
+
+func TestResolvers_validateProtocol(t *testing.T) {
+	pin := PinSet{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="}
+
+	tests := []struct {
+		name     string
+		resolver ResolverEntry
+		valid    bool
+	}{
+		{"default", ResolverEntry{Address: "9.9.9.9:853"}, true},
+		{"tls", ResolverEntry{Address: "9.9.9.9:853", Protocol: "tls", Pin: pin}, true},
+		{"tcp", ResolverEntry{Address: "10.0.0.53:53", Protocol: "tcp"}, true},
+		{"udp", ResolverEntry{Address: "10.0.0.53:53", Protocol: "udp"}, true},
+		{"unsupported", ResolverEntry{Address: "10.0.0.53:53", Protocol: "quic"}, false},
+		{"udp with url", ResolverEntry{URL: "https://dns.quad9.net/dns-query", Protocol: "udp"}, false},
+		{"udp with pins", ResolverEntry{Address: "10.0.0.53:53", Protocol: "udp", Pin: pin}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.resolver.validateProtocol(); (err == nil) != tt.valid {
+				t.Errorf("wanted valid %v got %v", tt.valid, err)
+			}
+		})
+	}
+}
@@ -1,53 +1,126 @@
 package veild
 
 import (
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"sync"
+	"time"
 )
 
-// ResponseCache represents a response cache.
+// ErrNoFreeTransactionIDs is returned when every transaction ID is in use on a connection.
+var ErrNoFreeTransactionIDs = errors.New("no free transaction ids")
+
+// ResponseCache holds the requests in flight on an upstream connection, keyed
+// by the transaction ID they were sent upstream with.
 type ResponseCache struct {
 	mu        sync.Mutex
-	responses map[cacheKey]*Request
+	responses map[uint16]*pendingRequest
 	log       *slog.Logger
 }
 
+// pendingRequest is a [Request] waiting on a response from upstream.
+type pendingRequest struct {
+	request *Request
+	sent    time.Time
+}
+
 // NewResponseCache handles ResponseCache initialization.
 func NewResponseCache(logger *slog.Logger) *ResponseCache {
 	return &ResponseCache{
-		responses: make(map[cacheKey]*Request),
+		responses: make(map[uint16]*pendingRequest),
 		log:       logger.With("module", "response_cache"),
 	}
 }
 
-// Set adds a [Request] to the cache.
-func (rc *ResponseCache) Set(value *Request) {
+// Add assigns a random, unused upstream transaction ID to a [Request] and adds
+// it to the cache. Clients pick their own IDs, so two clients can easily send
+// the same ID, and random IDs make responses harder to spoof.
+func (rc *ResponseCache) Add(value *Request) (uint16, error) {
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
 
-	rc.responses[value.cacheKey()] = value
+	if len(rc.responses) > 0xffff {
+		return 0, ErrNoFreeTransactionIDs
+	}
+
+	for {
+		id := uint16(rand.Uint32())
+		if _, ok := rc.responses[id]; !ok {
+			rc.responses[id] = &pendingRequest{value, time.Now()}
+			return id, nil
+		}
+	}
 }
 
-// Get gets a [Request] from the cache.
-func (rc *ResponseCache) Get(key cacheKey) (*Request, bool) {
+// Match gets the [Request] a response is for from the cache. Both the transaction
+// ID and the question must match what was sent upstream.
+func (rc *ResponseCache) Match(response []byte) (*Request, bool) {
+	id := binary.BigEndian.Uint16(response[:2])
+
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
 
-	if request, ok := rc.responses[key]; ok {
-		delete(rc.responses, key)
-		return request, true
+	pending, ok := rc.responses[id]
+	if !ok {
+		return nil, false
 	}
-	return &Request{}, false
+
+	if !questionMatches(pending.request.data, response) {
+		rc.log.Warn("Response question doesn't match request", "trx_id", fmt.Sprintf("0x%x", id))
+		return nil, false
+	}
+
+	delete(rc.responses, id)
+	return pending.request, true
+}
+
+// Expired removes and returns the requests which have been waiting on a
+// response for longer than timeout.
+func (rc *ResponseCache) Expired(timeout time.Duration) []*Request {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	var expired []*Request
+	for id, pending := range rc.responses {
+		if time.Since(pending.sent) > timeout {
+			expired = append(expired, pending.request)
+			delete(rc.responses, id)
+		}
+	}
+	return expired
+}
+
+// Drain removes and returns all the requests in the cache.
+func (rc *ResponseCache) Drain() []*Request {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	var drained []*Request
+	for id, pending := range rc.responses {
+		drained = append(drained, pending.request)
+		delete(rc.responses, id)
+	}
+	return drained
+}
+
+// Len returns the number of requests waiting on a response.
+func (rc *ResponseCache) Len() int {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	return len(rc.responses)
 }
 
 // Exists checks if an entry exists in the cache.
-func (rc *ResponseCache) Exists(key cacheKey) bool {
+func (rc *ResponseCache) Exists(id uint16) bool {
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
 
-	_, ok := rc.responses[key]
+	_, ok := rc.responses[id]
 	return ok
 }
 
@@ -56,8 +129,8 @@ func (rc *ResponseCache) Entries(f io.Writer) {
 	rc.mu.Lock()
 	defer rc.mu.Unlock()
 
-	for _, response := range rc.responses {
-		rr, _ := NewRR(response.data[DNSHeaderLength:])
+	for _, pending := range rc.responses {
+		rr, _ := NewRR(pending.request.data[DNSHeaderLength:])
 
 		fmt.Fprintf(f, "%s, %s\n", rr.hostname, rr.rType)
 	}
@@ -1,16 +1,17 @@
 package veild
 
 import (
+	"encoding/binary"
 	"log/slog"
 	"os"
+	"slices"
 	"testing"
+	"time"
 )
 
 func newRequest() *Request {
 	return &Request{
-		data: []byte{
-			0xa, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x6e, 0x6d,
-			0x61, 0x69, 0x6c, 0x3, 0x63, 0x6f, 0x6d, 0x0},
+		data: newTestQuery("protonmail.com", 1),
 	}
 }
 
@@ -22,32 +23,120 @@ func newLogger() *slog.Logger {
 	)
 }
 
-func TestResponseCache_Set(t *testing.T) {
+// upstreamResponse forms a response to a request as it was sent upstream with id.
+func upstreamResponse(r *Request, id uint16) []byte {
+	response := newResponse(r.data, rcodeSuccess)
+	binary.BigEndian.PutUint16(response[:2], id)
+	return response
+}
+
+func TestResponseCache_Add(t *testing.T) {
 	logger := newLogger()
 
 	responseCache := NewResponseCache(logger)
 
-	v := newRequest()
-	responseCache.Set(v)
+	// Two clients using the same transaction ID.
+	first, second := newRequest(), newRequest()
+
+	firstID, _ := responseCache.Add(first)
+	secondID, _ := responseCache.Add(second)
+
+	if firstID == secondID {
+		t.Error("expected requests to be assigned different IDs")
+	}
 
-	if !responseCache.Exists(v.cacheKey()) {
+	if !responseCache.Exists(firstID) || !responseCache.Exists(secondID) {
 		t.Error("should exist")
 	}
 }
 
-func TestResponseCache_Get(t *testing.T) {
+func TestResponseCache_Match(t *testing.T) {
 	logger := newLogger()
 	responseCache := NewResponseCache(logger)
 
 	v := newRequest()
-	responseCache.Set(v)
-	_, ok := responseCache.Get(v.cacheKey())
-	if !ok {
+	id, _ := responseCache.Add(v)
+
+	got, ok := responseCache.Match(upstreamResponse(v, id))
+	if !ok || got != v {
 		t.Error("should exist")
 	}
 
-	_, ok = responseCache.Get(v.cacheKey())
+	_, ok = responseCache.Match(upstreamResponse(v, id))
 	if ok {
 		t.Error("shouldn't exist")
 	}
 }
+
+func TestResponseCache_Match_question(t *testing.T) {
+	logger := newLogger()
+	responseCache := NewResponseCache(logger)
+
+	v := newRequest()
+	id, _ := responseCache.Add(v)
+
+	// Resolvers may change the case of the name.
+	response := upstreamResponse(v, id)
+	response[14] = 'R'
+
+	if _, ok := responseCache.Match(response); !ok {
+		t.Error("expected question to match regardless of case")
+	}
+
+	// A response with the right ID but for another name mustn't match.
+	other := &Request{data: newTestQuery("example.com", 1)}
+	id, _ = responseCache.Add(v)
+
+	if _, ok := responseCache.Match(upstreamResponse(other, id)); ok {
+		t.Error("expected mismatched question not to match")
+	}
+
+	if !responseCache.Exists(id) {
+		t.Error("expected request to remain after a mismatched response")
+	}
+}
+
+func TestResponseCache_Match_unknown(t *testing.T) {
+	responseCache := NewResponseCache(newLogger())
+
+	response := slices.Clone(newRequest().data)
+	if _, ok := responseCache.Match(response); ok {
+		t.Error("shouldn't exist")
+	}
+}
+
+func TestResponseCache_Expired(t *testing.T) {
+	responseCache := NewResponseCache(newLogger())
+
+	v := newRequest()
+	id, _ := responseCache.Add(v)
+
+	if got := responseCache.Expired(time.Minute); len(got) != 0 {
+		t.Errorf("expected nothing to have expired, got %d", len(got))
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if got := responseCache.Expired(time.Millisecond); len(got) != 1 || got[0] != v {
+		t.Error("expected request to have expired")
+	}
+
+	if responseCache.Exists(id) {
+		t.Error("expected expired request to be removed")
+	}
+}
+
+func TestResponseCache_Drain(t *testing.T) {
+	responseCache := NewResponseCache(newLogger())
+
+	responseCache.Add(newRequest())
+	responseCache.Add(newRequest())
+
+	if got := responseCache.Drain(); len(got) != 2 {
+		t.Errorf("wanted 2 requests got %d", len(got))
+	}
+
+	if got := responseCache.Drain(); len(got) != 0 {
+		t.Errorf("expected cache to be empty, got %d", len(got))
+	}
+}
@@ -0,0 +1,276 @@
+package veild
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// defaultRewriteTTL is the TTL, in seconds, of the CNAMEs for rewritten names.
+const defaultRewriteTTL = 300
+
+// rewriteTimeout is how long a rewritten request waits on its target to be
+// resolved before giving up.
+const rewriteTimeout = 10 * time.Second
+
+// safeSearchRewrites enforce safe search on the major search engines and
+// restricted mode on YouTube.
+var safeSearchRewrites = []RewriteEntry{
+	{From: "google.com", To: "forcesafesearch.google.com"},
+	{From: "www.google.com", To: "forcesafesearch.google.com"},
+	{From: "www.google.co.uk", To: "forcesafesearch.google.com"},
+	{From: "www.google.ca", To: "forcesafesearch.google.com"},
+	{From: "www.google.com.au", To: "forcesafesearch.google.com"},
+	{From: "www.google.de", To: "forcesafesearch.google.com"},
+	{From: "www.google.fr", To: "forcesafesearch.google.com"},
+	{From: "bing.com", To: "strict.bing.com"},
+	{From: "www.bing.com", To: "strict.bing.com"},
+	{From: "duckduckgo.com", To: "safe.duckduckgo.com"},
+	{From: "www.duckduckgo.com", To: "safe.duckduckgo.com"},
+	{From: "youtube.com", To: "restrict.youtube.com"},
+	{From: "www.youtube.com", To: "restrict.youtube.com"},
+	{From: "m.youtube.com", To: "restrict.youtube.com"},
+	{From: "youtubei.googleapis.com", To: "restrict.youtube.com"},
+	{From: "youtube.googleapis.com", To: "restrict.youtube.com"},
+	{From: "www.youtube-nocookie.com", To: "restrict.youtube.com"},
+}
+
+// RewriteEntry implements a rewrite rule. From is either a name, which only
+// matches itself, or `*.example.com` which matches the subdomains of
+// example.com. Matching names are answered with a CNAME to To along with its
+// records, or with just the records of To when Flatten is set.
+type RewriteEntry struct {
+	From    string
+	To      string
+	Flatten bool
+}
+
+// RewriteEntries implements a list of rewrite rules.
+type RewriteEntries struct {
+	Rewrites []RewriteEntry
+}
+
+var (
+	ErrReadingRewritesFile   = errors.New("reading rewrites file")
+	ErrUnmarshallingRewrites = errors.New("error unmarshalling rewrites file")
+	ErrInvalidRewrite        = errors.New("invalid rewrite")
+)
+
+// Rewrites answers queries for one name with the records of another.
+type Rewrites struct {
+	mu    sync.Mutex
+	rules *domainTrie[RewriteEntry]
+	log   *slog.Logger
+}
+
+// NewRewrites loads rewrite rules from a file, if given, on top of the safe
+// search rules if safeSearch is set.
+func NewRewrites(rewritesPath string, safeSearch bool, logger *slog.Logger) (*Rewrites, error) {
+	r := &Rewrites{
+		rules: &domainTrie[RewriteEntry]{},
+		log:   logger.With("module", "rewrites"),
+	}
+
+	if safeSearch {
+		if err := r.load(safeSearchRewrites); err != nil {
+			return nil, errors.Join(ErrInvalidRewrite, err)
+		}
+	}
+
+	if rewritesPath == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(rewritesPath)
+	if err != nil {
+		return nil, errors.Join(ErrReadingRewritesFile, err)
+	}
+
+	rewrites := &RewriteEntries{}
+	if err := yaml.Unmarshal(data, &rewrites); err != nil {
+		return nil, errors.Join(ErrUnmarshallingRewrites, err)
+	}
+
+	if err := r.load(rewrites.Rewrites); err != nil {
+		return nil, errors.Join(ErrInvalidRewrite, err)
+	}
+
+	return r, nil
+}
+
+// load validates and adds rules, replacing any earlier rules for the same name.
+func (r *Rewrites) load(entries []RewriteEntry) error {
+	for _, entry := range entries {
+		entry.To = normalizeDomain(entry.To)
+		if !validDomain(entry.To) {
+			return fmt.Errorf("%s: invalid target %q", entry.From, entry.To)
+		}
+
+		if !r.rules.Insert(entry.From, entry) {
+			return fmt.Errorf("%q: invalid name", entry.From)
+		}
+	}
+
+	return nil
+}
+
+// Match returns the rule rewriting host, if any. Wildcard rules match any
+// subdomain, the rest only match the name itself.
+func (r *Rewrites) Match(host string) (RewriteEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name := normalizeDomain(host)
+
+	matches := r.rules.MatchAll(name)
+	for _, match := range slices.Backward(matches) {
+		if strings.HasPrefix(match.rule, "*.") || normalizeDomain(match.rule) == name {
+			return match.value, true
+		}
+	}
+
+	return RewriteEntry{}, false
+}
+
+// replace swaps in the rules from other.
+func (r *Rewrites) replace(other *Rewrites) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rules = other.rules
+}
+
+// Len returns the number of rules.
+func (r *Rewrites) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.rules.Len()
+}
+
+// resolveRewrite resolves the target of a rewrite rule through the normal
+// path (local records, blocklist, cache and upstream) and answers request
+// with the result. Targets aren't rewritten again.
+func resolveRewrite(p *Pool, request *Request, rule RewriteEntry, mainLog *slog.Logger) {
+	responses := make(chanConn, 1)
+
+	target := &Request{
+		clientConn: responses,
+		data:       renameQuestion(request.data, rule.To),
+		start:      time.Now(),
+		maxSize:    maxMessageLength,
+		rewritten:  true,
+	}
+
+	resolve(p, target, mainLog)
+
+	select {
+	case response := <-responses:
+		request.write(rewriteResponse(request.data, response, rule))
+	case <-time.After(rewriteTimeout):
+		mainLog.Warn("Timed out resolving rewrite", "target", rule.To)
+		request.write(newResponse(request.data, rcodeServFail))
+	}
+}
+
+// renameQuestion returns a copy of query asking about name instead.
+func renameQuestion(query []byte, name string) []byte {
+	msg, err := parseMessage(query)
+	if err != nil || msg.questionEnd == DNSHeaderLength {
+		return query
+	}
+
+	nameEnd, _ := skipName(query, DNSHeaderLength)
+
+	return slices.Concat(query[:DNSHeaderLength], encodeName(name), query[nameEnd:])
+}
+
+// rewriteResponse forms the answer to query from the response for the
+// rule's target, either as a CNAME followed by the target's records or, if
+// flattened, the target's records of the type asked for under the name asked
+// for. Negative responses keep their rcode and are given an SOA.
+func rewriteResponse(query, response []byte, rule RewriteEntry) []byte {
+	msg, err := parseMessage(response)
+	if err != nil {
+		return newResponse(query, rcodeServFail)
+	}
+
+	rc := rcode(response)
+	if rc != rcodeSuccess && rc != rcodeNXDomain {
+		return newResponse(query, rc)
+	}
+
+	rewritten := newResponse(query, rc)
+	rType := questionType(query)
+
+	if !rule.Flatten {
+		rewritten = appendRecord(rewritten, answerCount, typeCNAME, defaultRewriteTTL, encodeName(rule.To))
+	}
+
+	answers := 0
+	for _, rr := range msg.answers {
+		rdata, err := recordData(response, rr)
+		if err != nil {
+			return newResponse(query, rcodeServFail)
+		}
+		ttl := binary.BigEndian.Uint32(response[rr.ttl:])
+
+		if rule.Flatten {
+			if rr.rType != rType && rType != typeANY {
+				continue
+			}
+			rewritten = appendRecord(rewritten, answerCount, rr.rType, ttl, rdata)
+		} else {
+			owner, err := decodeName(response, rr.offset)
+			if err != nil {
+				return newResponse(query, rcodeServFail)
+			}
+			rewritten = appendNamedRecord(rewritten, answerCount, encodeName(owner), rr.rType, ttl, rdata)
+		}
+		answers++
+	}
+
+	if answers == 0 {
+		ttl, ok := minTTL(response)
+		if !ok {
+			ttl = defaultRewriteTTL
+		}
+		rewritten = appendSOA(rewritten, ttl)
+	}
+
+	return rewritten
+}
+
+// recordData returns a record's RDATA with any compressed names expanded, so
+// that it can be copied into another message.
+func recordData(data []byte, rr resourceRecord) ([]byte, error) {
+	rdata := data[rr.rdata:rr.end()]
+
+	switch rr.rType {
+	case typeCNAME, typePTR, typeNS:
+		name, err := decodeName(data, rr.rdata)
+		if err != nil {
+			return nil, err
+		}
+		return encodeName(name), nil
+	case typeMX:
+		if rr.rdLength < 3 {
+			return nil, ErrInvalidDNSPacket
+		}
+		name, err := decodeName(data, rr.rdata+2)
+		if err != nil {
+			return nil, err
+		}
+		return slices.Concat(rdata[:2], encodeName(name)), nil
+	}
+
+	return slices.Clone(rdata), nil
+}
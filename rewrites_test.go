@@ -0,0 +1,148 @@
+package veild
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRewrites_Match(t *testing.T) {
+	rewrites, err := NewRewrites("fixtures/test_rewrites.yml", true, newLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"www.google.com", "forcesafesearch.google.com"},
+		{"WWW.Bing.com.", "strict.bing.com"},
+		{"mail.google.com", ""},
+		{"forcesafesearch.google.com", ""},
+		{"api.dev.local", "devbox.lan"},
+		{"www.api.dev.local", "devbox.lan"},
+		{"dev.local", ""},
+		// The file's rules override the safe search ones.
+		{"youtube.com", "restrictmoderate.youtube.com"},
+		{"www.youtube.com", "restrict.youtube.com"},
+	}
+
+	for _, tt := range tests {
+		rule, ok := rewrites.Match(tt.host)
+		if ok != (tt.want != "") || rule.To != tt.want {
+			t.Errorf("%s: wanted %q got %q", tt.host, tt.want, rule.To)
+		}
+	}
+}
+
+func TestRewrites_NewRewrites_invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    error
+	}{
+		{"malformed", "rewrites: [\n", ErrUnmarshallingRewrites},
+		{"invalid name", "rewrites:\n  - {from: \"*.\", to: devbox.lan}\n", ErrInvalidRewrite},
+		{"invalid target", "rewrites:\n  - {from: dev.local, to: \"devbox..lan\"}\n", ErrInvalidRewrite},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rewrites.yml")
+			os.WriteFile(path, []byte(tt.content), 0o600)
+
+			if _, err := NewRewrites(path, false, newLogger()); !errors.Is(err, tt.want) {
+				t.Errorf("wanted %v got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func Test_renameQuestion(t *testing.T) {
+	query := newTestQuery("www.google.com", typeAAAA)
+
+	renamed := renameQuestion(query, "forcesafesearch.google.com")
+
+	rr, err := NewRR(renamed[DNSHeaderLength:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.hostname != "forcesafesearch.google.com" || rr.rType != "AAAA" {
+		t.Errorf("wanted AAAA forcesafesearch.google.com got %s %s", rr.rType, rr.hostname)
+	}
+
+	// The rest of the query, like the OPT record, is kept.
+	if edns, err := parseEDNS(renamed); err != nil || edns == nil {
+		t.Errorf("expected OPT record to be kept, got %v", err)
+	}
+}
+
+func Test_rewriteResponse(t *testing.T) {
+	// A chain of CNAMEs ending in an A record.
+	target, _ := os.ReadFile("fixtures/phishing-detection.api.cx.metamask.io_a.pkt")
+	chain := answerStrings(t, target)
+
+	tests := []struct {
+		name     string
+		response []byte
+		rule     RewriteEntry
+		rcode    int
+		answers  []string
+	}{
+		{
+			name:     "CNAME",
+			response: target,
+			rule:     RewriteEntry{To: "phishing-detection.api.cx.metamask.io"},
+			rcode:    rcodeSuccess,
+			answers:  slices.Concat([]string{"CNAME phishing-detection.api.cx.metamask.io"}, chain),
+		},
+		{
+			name:     "flattened",
+			response: target,
+			rule:     RewriteEntry{To: "phishing-detection.api.cx.metamask.io", Flatten: true},
+			rcode:    rcodeSuccess,
+			answers:  []string{"A 13.107.246.64"},
+		},
+		{
+			name:     "NXDOMAIN",
+			response: newNegativeResponse(rcodeNXDomain, 60, 60),
+			rule:     RewriteEntry{To: "example.com"},
+			rcode:    rcodeNXDomain,
+			answers:  []string{"CNAME example.com"},
+		},
+		{
+			name:     "SERVFAIL",
+			response: newResponse(newTestQuery("example.com", typeA), rcodeServFail),
+			rule:     RewriteEntry{To: "example.com"},
+			rcode:    rcodeServFail,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := newTestQuery("api.dev.local", typeA)
+
+			response := rewriteResponse(query, tt.response, tt.rule)
+
+			if got := rcode(response); got != tt.rcode {
+				t.Errorf("wanted rcode %d got %d", tt.rcode, got)
+			}
+
+			if got := answerStrings(t, response); !slices.Equal(got, tt.answers) {
+				t.Errorf("wanted answers %v got %v", tt.answers, got)
+			}
+
+			// The first answer is always for the name asked for.
+			msg, _ := parseMessage(response)
+			if len(msg.answers) > 0 {
+				if owner, _ := decodeName(response, msg.answers[0].offset); owner != "api.dev.local" {
+					t.Errorf("wanted first answer for api.dev.local got %s", owner)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package veild
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// Idle timeouts for stream connections, how long a connection can sit idle
+// between queries before we close it. Encrypted connections are more costly
+// to setup so are kept around for longer.
+// SEE: https://datatracker.ietf.org/doc/html/rfc7766#section-6.2.3
+// SEE: https://datatracker.ietf.org/doc/html/rfc7858#section-3.4
+const (
+	tcpIdleTimeout = 10 * time.Second
+	dotIdleTimeout = 30 * time.Second
+)
+
+// serveUDP reads requests from the UDP listener and hands them off to resolve.
+func serveUDP(conn *net.UDPConn, p *Pool, mainLog *slog.Logger) {
+	for {
+		buff := make([]byte, DNSPacketLength)
+		n, clientAddr, err := conn.ReadFromUDP(buff)
+		if err != nil {
+			mainLog.Warn("Error reading from UDP listener", "err", err)
+			continue
+		}
+
+		// Potential to catch small packets here.
+		if n < DNSHeaderLength {
+			mainLog.Warn("Packet length too small", "length", n)
+			continue
+		}
+
+		request := &Request{
+			clientAddr: clientAddr,
+			clientConn: conn,
+			data:       buff[:n],
+			start:      time.Now(),
+			maxSize:    udpPayloadSize(buff[:n])}
+
+		numRequests.Add(1)
+
+		mainLog.Info("Requests", "requests", numRequests.Load(), "context", "stats")
+
+		// Spin up new goroutine per request.
+		go resolve(p, request, mainLog)
+	}
+}
+
+// serveTCP accepts stream connections and serves each in its own goroutine.
+// The listener may be a TLS listener, in which case this serves DNS-over-TLS.
+func serveTCP(ln net.Listener, idleTimeout time.Duration, p *Pool, mainLog *slog.Logger) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			mainLog.Warn("Error accepting connection", "err", err)
+			continue
+		}
+
+		go serveStream(conn, idleTimeout, p, mainLog)
+	}
+}
+
+// serveStream reads length prefixed requests from a single client connection.
+// Multiple queries can be pipelined on the same connection, each one is
+// resolved concurrently and answered as soon as it's ready, so responses
+// may be returned out of order. The connection only counts as idle while
+// there are no queries waiting on an answer.
+func serveStream(conn net.Conn, idleTimeout time.Duration, p *Pool, mainLog *slog.Logger) {
+	defer conn.Close()
+
+	clientConn := &streamConn{conn: conn}
+	reader := bufio.NewReader(conn)
+
+	mainLog.Debug("New stream connection", "client_ip", conn.RemoteAddr())
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+
+		// Wait on the start of the next query, nothing's been read from it if
+		// this times out so we can carry on waiting.
+		if _, err := reader.Peek(1); errors.Is(err, os.ErrDeadlineExceeded) && clientConn.pending.Load() > 0 {
+			continue
+		}
+
+		data, err := readMessage(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				mainLog.Debug("Closing stream connection", "client_ip", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+
+		if len(data) < DNSHeaderLength {
+			mainLog.Warn("Packet length too small", "length", len(data))
+			return
+		}
+
+		request := &Request{
+			clientAddr: conn.RemoteAddr(),
+			clientConn: clientConn,
+			data:       data,
+			start:      time.Now(),
+			maxSize:    maxMessageLength}
+
+		numRequests.Add(1)
+		clientConn.pending.Add(1)
+
+		mainLog.Info("Requests", "requests", numRequests.Load(), "context", "stats")
+
+		go resolve(p, request, mainLog)
+	}
+}
+
+// newServerTLSConfig loads the certificate and key used to serve encrypted clients.
+func newServerTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
@@ -0,0 +1,145 @@
+package veild
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_serveTCP_dot(t *testing.T) {
+	setupTestBlocklist(t)
+	logger := newLogger()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{newTestCertificate(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go serveTCP(ln, dotIdleTimeout, NewPool(logger), logger)
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Pipeline two queries on the same connection.
+	first := newTestQuery("0-edge-chat.facebook.com", 1)
+	second := newTestQuery("1-edge-chat.facebook.com", 28)
+	second[0], second[1] = 0x12, 0x34
+
+	conn.Write(append(packMessage(first), packMessage(second)...))
+
+	ids := map[[2]byte]bool{}
+	for range 2 {
+		response, err := readMessage(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rcode(response) != rcodeNXDomain {
+			t.Errorf("wanted NXDOMAIN got rcode %d", rcode(response))
+		}
+		ids[[2]byte(response[:2])] = true
+	}
+
+	if !ids[[2]byte(first[:2])] || !ids[[2]byte(second[:2])] {
+		t.Errorf("expected a response for both queries, got %v", ids)
+	}
+}
+
+func TestServer_serveTCP_idleTimeout(t *testing.T) {
+	logger := newLogger()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go serveTCP(ln, 50*time.Millisecond, NewPool(logger), logger)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The server should close the connection once it's been idle for too long.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expected connection to be closed")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Error("expected server to close the connection before our deadline")
+	}
+}
+
+func TestServer_serveStream_pending(t *testing.T) {
+	config = &Config{}
+	logger := newLogger()
+	pool := NewPool(logger)
+
+	server, client := net.Pipe()
+	defer client.Close()
+
+	go serveStream(server, 50*time.Millisecond, pool, logger)
+
+	query := newTestQuery("protonmail.com", 1)
+	client.Write(packMessage(query))
+
+	// The connection isn't idle while the query is waiting on upstream.
+	request := <-pool.requests
+	time.Sleep(200 * time.Millisecond)
+	go request.write(newResponse(request.data, rcodeServFail))
+
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	response, err := readMessage(client)
+	if err != nil {
+		t.Fatalf("expected the pending query to be answered, got %v", err)
+	}
+	if !bytes.Equal(response[:2], query[:2]) {
+		t.Errorf("wanted response to the query got %v", response)
+	}
+
+	// Once answered it's closed after being idle.
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Error("expected connection to be closed")
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		t.Error("expected server to close the connection before our deadline")
+	}
+}
+
+func TestServer_serveTCP_malformed(t *testing.T) {
+	config = &Config{}
+	logger := newLogger()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go serveTCP(ln, tcpIdleTimeout, NewPool(logger), logger)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The first label runs past the end of the message.
+	query := []byte{0xab, 0xcd, 0x01, 0x00, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3f, 'a', 0x0, 0x0, 0x1}
+	conn.Write(packMessage(query))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	response, err := readMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(response[:2], query[:2]) || rcode(response) != rcodeFormErr {
+		t.Errorf("wanted FORMERR for the query got %v", response)
+	}
+}
@@ -0,0 +1,68 @@
+package veild
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxMessageLength is the largest DNS message that can be sent over a stream.
+const maxMessageLength = 65535
+
+// streamWriteTimeout is how long we wait for a response to be written back
+// to a stream based client before giving up.
+const streamWriteTimeout = 5 * time.Second
+
+// readMessage reads a single length prefixed DNS message from a stream.
+// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.2
+func readMessage(r io.Reader) ([]byte, error) {
+	packetLength := make([]byte, 2)
+	if _, err := io.ReadFull(r, packetLength); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(packetLength))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// packMessage prepends the two byte length prefix to a DNS message.
+func packMessage(data []byte) []byte {
+	packet := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(packet, uint16(len(data)))
+	return append(packet, data...)
+}
+
+// streamConn wraps a stream based client connection so that it can be used
+// as a [RequestConn]. Responses are length prefixed and writes are serialised
+// as multiple requests on the same connection may complete at once.
+type streamConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+
+	// pending counts the requests on the connection yet to be answered.
+	pending atomic.Int64
+}
+
+// WriteTo writes a length prefixed response to the underlying connection.
+// The address is ignored as the connection is already bound to the client.
+func (s *streamConn) WriteTo(b []byte, _ net.Addr) (int, error) {
+	defer s.pending.Add(-1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+
+	n, err := s.conn.Write(packMessage(b))
+	if n >= 2 {
+		n -= 2
+	}
+	return n, err
+}
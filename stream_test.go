@@ -0,0 +1,57 @@
+package veild
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestStream_readMessage(t *testing.T) {
+	want := []byte{0x53, 0x01, 0x01, 0x20}
+
+	// Two pipelined messages on the same stream.
+	stream := bytes.NewReader(append(packMessage(want), packMessage(want)...))
+
+	for range 2 {
+		got, err := readMessage(stream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("wanted %v got %v", want, got)
+		}
+	}
+
+	if _, err := readMessage(stream); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
+
+func TestStream_readMessage_short(t *testing.T) {
+	// Length says 4 bytes but only 2 are available.
+	stream := bytes.NewReader([]byte{0x0, 0x4, 0x53, 0x01})
+
+	if _, err := readMessage(stream); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF, got %v", err)
+	}
+}
+
+func TestStream_streamConn_WriteTo(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	sc := &streamConn{conn: server}
+	want := []byte{0x53, 0x01, 0x81, 0x80}
+
+	go sc.WriteTo(want, nil)
+
+	got, err := readMessage(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("wanted %v got %v", want, got)
+	}
+}
@@ -0,0 +1,21 @@
+package veild
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// TCPResolverDialer connects to resolvers over plain DNS over TCP, for local
+// and internal resolvers which don't support encryption.
+type TCPResolverDialer struct{}
+
+// DialConn dials the resolver, DNS over TCP is already length prefixed.
+// SEE: https://datatracker.ietf.org/doc/html/rfc7766
+func (t TCPResolverDialer) DialConn(re ResolverEntry) (io.ReadWriteCloser, error) {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+	}
+
+	return dialer.Dial("tcp", re.Address)
+}
@@ -1,12 +1,21 @@
 package veild
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
 	"io"
 	"net"
+	"slices"
 	"time"
 )
 
+// ErrPinMismatch is returned when none of the certificates presented by a
+// resolver match its configured SPKI pin set.
+var ErrPinMismatch = errors.New("spki pin mismatch")
+
 type TLSResolverDialer struct{}
 
 // dialConn handles dialing the outbound connection to the underlying DNS server.
@@ -15,8 +24,79 @@ func (t TLSResolverDialer) DialConn(re ResolverEntry) (io.ReadWriteCloser, error
 		Timeout: 5 * time.Second,
 	}
 
-	return tls.DialWithDialer(dialer, "tcp", re.Address, &tls.Config{
+	conn, err := tls.DialWithDialer(dialer, "tcp", re.Address, newTLSConfig(re))
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// newTLSConfig builds the TLS config for connecting to a resolver. If the resolver
+// has a pin set then the presented certificates must match one of the pins.
+// SEE: https://datatracker.ietf.org/doc/html/rfc7858#section-4.2
+func newTLSConfig(re ResolverEntry) *tls.Config {
+	tlsConfig := &tls.Config{
 		ServerName: re.Hostname,
 		MinVersion: tls.VersionTLS13,
-	})
+	}
+
+	if len(re.Pin) == 0 {
+		return tlsConfig
+	}
+
+	// Pinned resolvers can opt out of WebPKI verification, e.g. for self-signed
+	// certificates. VerifyPeerCertificate is still called in this case.
+	tlsConfig.InsecureSkipVerify = re.PinOnly
+	tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		return re.Pin.verifyPeer(rawCerts, verifiedChains, re.PinOnly)
+	}
+
+	return tlsConfig
+}
+
+// verifyPeer checks the certificates presented by a resolver against the pin
+// set. The rest of what the server sends is unverified and could be anything,
+// so only the leaf is checked for pin-only resolvers, as the handshake proves
+// the server holds its key. Otherwise any certificate in a verified chain can
+// match.
+func (p PinSet) verifyPeer(rawCerts [][]byte, verifiedChains [][]*x509.Certificate, pinOnly bool) error {
+	if pinOnly {
+		if len(rawCerts) == 0 {
+			return ErrPinMismatch
+		}
+
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+
+		return p.verify([]*x509.Certificate{leaf})
+	}
+
+	for _, chain := range verifiedChains {
+		if p.verify(chain) == nil {
+			return nil
+		}
+	}
+
+	return ErrPinMismatch
+}
+
+// verify checks that at least one of the certificates matches the pin set.
+func (p PinSet) verify(certs []*x509.Certificate) error {
+	for _, cert := range certs {
+		if slices.Contains(p, spkiFingerprint(cert)) {
+			return nil
+		}
+	}
+
+	return ErrPinMismatch
+}
+
+// spkiFingerprint returns the base64 encoded SHA-256 digest of a certificate's
+// SubjectPublicKeyInfo.
+func spkiFingerprint(cert *x509.Certificate) string {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(digest[:])
 }
@@ -0,0 +1,157 @@
+package veild
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestCertificate creates a self-signed certificate for 127.0.0.1.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "veild.test"},
+		DNSNames:     []string{"veild.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, _ := x509.ParseCertificate(der)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// newTestTLSListener starts a TLS listener which completes handshakes and
+// then closes the connection.
+func newTestTLSListener(t *testing.T, cert tls.Certificate) net.Listener {
+	t.Helper()
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	return ln
+}
+
+func TestTLSResolverDialer_DialConn_pinning(t *testing.T) {
+	cert := newTestCertificate(t)
+	ln := newTestTLSListener(t, cert)
+
+	pin := spkiFingerprint(cert.Leaf)
+	otherPin := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	tests := []struct {
+		name string
+		re   ResolverEntry
+		want error
+	}{
+		{
+			name: "matching pin",
+			re:   ResolverEntry{Hostname: "veild.test", Pin: PinSet{pin}, PinOnly: true},
+			want: nil,
+		},
+		{
+			name: "matching pin within a rotation set",
+			re:   ResolverEntry{Hostname: "veild.test", Pin: PinSet{otherPin, pin}, PinOnly: true},
+			want: nil,
+		},
+		{
+			name: "mismatched pin",
+			re:   ResolverEntry{Hostname: "veild.test", Pin: PinSet{otherPin}, PinOnly: true},
+			want: ErrPinMismatch,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.re.Address = ln.Addr().String()
+
+			conn, err := TLSResolverDialer{}.DialConn(test.re)
+			if !errors.Is(err, test.want) {
+				t.Errorf("wanted %v got %v", test.want, err)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+		})
+	}
+}
+
+func TestTLSResolverDialer_DialConn_webPKI(t *testing.T) {
+	cert := newTestCertificate(t)
+	ln := newTestTLSListener(t, cert)
+
+	// A matching pin doesn't skip WebPKI verification unless pin-only is set.
+	re := ResolverEntry{
+		Address:  ln.Addr().String(),
+		Hostname: "veild.test",
+		Pin:      PinSet{spkiFingerprint(cert.Leaf)},
+	}
+
+	conn, err := TLSResolverDialer{}.DialConn(re)
+	if err == nil {
+		conn.Close()
+		t.Error("expected self-signed certificate to be rejected")
+	}
+}
+
+func TestTLSResolverDialer_DialConn_appendedPin(t *testing.T) {
+	pinned := newTestCertificate(t)
+	attacker := newTestCertificate(t)
+
+	// The attacker holds the key for their own leaf and appends the public,
+	// pinned certificate to the chain they present.
+	ln := newTestTLSListener(t, tls.Certificate{
+		Certificate: [][]byte{attacker.Certificate[0], pinned.Certificate[0]},
+		PrivateKey:  attacker.PrivateKey,
+	})
+
+	re := ResolverEntry{
+		Address:  ln.Addr().String(),
+		Hostname: "veild.test",
+		Pin:      PinSet{spkiFingerprint(pinned.Leaf)},
+		PinOnly:  true,
+	}
+
+	conn, err := TLSResolverDialer{}.DialConn(re)
+	if !errors.Is(err, ErrPinMismatch) {
+		t.Errorf("wanted %v got %v", ErrPinMismatch, err)
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
@@ -0,0 +1,124 @@
+package veild
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// udpRetransmitTimeout is how long we wait on a response before sending a
+	// query again, up to udpAttempts times.
+	// SEE: https://datatracker.ietf.org/doc/html/rfc1035#section-4.2.1
+	udpRetransmitTimeout = time.Second
+	udpAttempts          = 3
+
+	// udpTCPTimeout is how long we wait on a query retried over TCP.
+	udpTCPTimeout = 5 * time.Second
+)
+
+// ErrUDPTimeout is returned when a resolver doesn't answer any of our attempts.
+var ErrUDPTimeout = errors.New("no response over udp")
+
+// UDPResolverDialer connects to resolvers over plain DNS over UDP, for local
+// and internal resolvers which don't support encryption.
+type UDPResolverDialer struct {
+	log *slog.Logger
+}
+
+// DialConn returns a connection which exchanges length prefixed DNS messages
+// with a resolver over UDP. Each query is sent from its own socket, so from a
+// random port, and truncated responses are retried over TCP.
+func (u UDPResolverDialer) DialConn(re ResolverEntry) (io.ReadWriteCloser, error) {
+	c := &udpClient{
+		dialer:  &net.Dialer{Timeout: 5 * time.Second},
+		address: re.Address,
+		log:     u.log,
+	}
+
+	return newPipeConn(c.exchange, nil), nil
+}
+
+// udpClient exchanges queries with a resolver over UDP.
+type udpClient struct {
+	dialer  *net.Dialer
+	address string
+	log     *slog.Logger
+}
+
+// exchange sends a query to the resolver and returns its response, retrying
+// over TCP if it's truncated.
+func (c *udpClient) exchange(query []byte) ([]byte, error) {
+	response, err := c.roundTrip(query)
+	if err == nil && truncated(response) {
+		response, err = c.roundTripTCP(query)
+	}
+
+	if err != nil {
+		if c.log != nil {
+			c.log.Warn("UDP request failed", "host", c.address, "err", err)
+		}
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// roundTrip sends a query over UDP, retransmitting it until a response
+// arrives. Anything which isn't a response to the query is ignored.
+func (c *udpClient) roundTrip(query []byte) ([]byte, error) {
+	conn, err := c.dialer.Dial("udp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buff := make([]byte, maxMessageLength)
+
+	for range udpAttempts {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		conn.SetReadDeadline(time.Now().Add(udpRetransmitTimeout))
+
+		for {
+			n, err := conn.Read(buff)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			response := buff[:n]
+			if n >= DNSHeaderLength && bytes.Equal(response[:2], query[:2]) && questionMatches(query, response) {
+				return bytes.Clone(response), nil
+			}
+		}
+	}
+
+	return nil, ErrUDPTimeout
+}
+
+// roundTripTCP sends a query over TCP, for responses too big for UDP.
+// SEE: https://datatracker.ietf.org/doc/html/rfc7766#section-5
+func (c *udpClient) roundTripTCP(query []byte) ([]byte, error) {
+	conn, err := c.dialer.Dial("tcp", c.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(udpTCPTimeout))
+
+	if _, err := conn.Write(packMessage(query)); err != nil {
+		return nil, err
+	}
+
+	return readMessage(conn)
+}
@@ -0,0 +1,133 @@
+package veild
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"slices"
+	"testing"
+)
+
+// newTestPlainServer starts a UDP server which answers each query with the
+// responses returned by respond, and a TCP server on the same port which
+// answers with the protonmail.com fixture.
+func newTestPlainServer(t *testing.T, respond func(query []byte) [][]byte) string {
+	t.Helper()
+
+	response, _ := os.ReadFile("fixtures/response_protonmail.com_a.pkt")
+
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+
+	tcpListener, err := net.Listen("tcp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tcpListener.Close() })
+
+	go func() {
+		buff := make([]byte, maxMessageLength)
+		for {
+			n, addr, err := udpConn.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			for _, resp := range respond(slices.Clone(buff[:n])) {
+				udpConn.WriteTo(resp, addr)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+			if query, err := readMessage(conn); err == nil {
+				conn.Write(packMessage(slices.Concat(query[:2], response[2:])))
+			}
+			conn.Close()
+		}
+	}()
+
+	return udpConn.LocalAddr().String()
+}
+
+func TestUDPResolverDialer_DialConn(t *testing.T) {
+	query, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+	response, _ := os.ReadFile("fixtures/response_protonmail.com_a.pkt")
+
+	tests := []struct {
+		name    string
+		respond func(query []byte) [][]byte
+	}{
+		{"answered", func(query []byte) [][]byte {
+			return [][]byte{slices.Concat(query[:2], response[2:])}
+		}},
+		{"ignores other responses", func(query []byte) [][]byte {
+			return [][]byte{
+				slices.Concat([]byte{query[0] ^ 0xff, query[1]}, response[2:]),
+				slices.Concat(query[:2], response[2:])[:DNSHeaderLength-1],
+				slices.Concat(query[:2], response[2:]),
+			}
+		}},
+		{"truncated retried over tcp", func(query []byte) [][]byte {
+			return [][]byte{truncate(slices.Concat(query[:2], response[2:]))}
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			address := newTestPlainServer(t, tt.respond)
+
+			conn, err := UDPResolverDialer{}.DialConn(ResolverEntry{Address: address, Protocol: protocolUDP})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write(packMessage(query)); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readMessage(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got[2:], response[2:]) || !bytes.Equal(got[:2], query[:2]) {
+				t.Errorf("expected response to match fixture, got %v", got)
+			}
+		})
+	}
+}
+
+func TestUDPResolverDialer_DialConn_servfail(t *testing.T) {
+	query, _ := os.ReadFile("fixtures/request_protonmail.com_a.pkt")
+
+	// Find a port with nothing listening on it.
+	listener, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	address := listener.LocalAddr().String()
+	listener.Close()
+
+	conn, err := UDPResolverDialer{}.DialConn(ResolverEntry{Address: address, Protocol: protocolUDP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write(packMessage(query))
+
+	got, err := readMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got[:2], query[:2]) || rcode(got) != rcodeServFail {
+		t.Errorf("wanted SERVFAIL for the query got %v", got)
+	}
+}
@@ -2,10 +2,16 @@
 package veild
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -20,15 +26,85 @@ type Config struct {
 	CachingEnabled   bool
 	BlocklistEnabled bool
 	BlocklistFile    string
-	ResolversFile    string
-	LogLevel         slog.Level
+	BlocklistFormat  string
+	BlocklistsFile   string
+	// BlockMode is how blocked queries are answered, see blockResponse. Blocked
+	// answers are given a TTL of BlockTTL and sinkhole mode answers with BlockAddrs.
+	BlockMode  string
+	BlockTTL   time.Duration
+	BlockAddrs []netip.Addr
+
+	AllowlistEnabled bool
+	AllowlistFile    string
+	AllowlistFormat  string
+
+	// LocalRecordsEnabled answers names in LocalRecordsFile directly, see
+	// NewLocalRecords.
+	LocalRecordsEnabled bool
+	LocalRecordsFile    string
+
+	// RewritesEnabled answers names matching a rule in RewritesFile, or the
+	// safe search rules with SafeSearch, with the records of another name.
+	RewritesEnabled bool
+	RewritesFile    string
+	SafeSearch      bool
+
+	ResolversFile string
+	LogLevel      slog.Level
+
+	// CacheMaxEntries and CacheMaxBytes limit the size of the query cache,
+	// 0 means no limit.
+	CacheMaxEntries int
+	CacheMaxBytes   int
+
+	// CacheFile is where the cache is saved to on exit (and periodically) and
+	// loaded from at startup.
+	CacheFile string
+
+	// StaleWindow is how long expired cache entries are kept around to be
+	// served when upstream resolution fails, or is still going after
+	// StaleAnswerTimeout (0 to only serve them on failures).
+	StaleWindow        time.Duration
+	StaleAnswerTimeout time.Duration
+
+	// PrefetchHits is how many cache hits an entry needs before it's refreshed
+	// ahead of expiring, once within PrefetchThreshold (a fraction) of its TTL.
+	// Prefetches are limited to PrefetchRate per second, 0 hits disables it.
+	PrefetchHits      int
+	PrefetchThreshold float64
+	PrefetchRate      int
+
+	// MinTTL and MaxTTL clamp the TTLs of cached answers (0 means no limit),
+	// MaxNegativeTTL caps how long NXDOMAIN and NODATA responses are cached for.
+	// With RewriteTTL the clamped TTLs are also passed on to clients.
+	MinTTL         time.Duration
+	MaxTTL         time.Duration
+	MaxNegativeTTL time.Duration
+	RewriteTTL     bool
+
+	// UpstreamTimeout is how long to wait on a response from upstream before
+	// retrying on another resolver, up to UpstreamRetries times. 0 uses
+	// defaultUpstreamTimeout.
+	UpstreamTimeout time.Duration
+	UpstreamRetries int
+
+	// DoHListenAddr and DoTListenAddr enable the DNS-over-HTTPS and
+	// DNS-over-TLS servers when set.
+	DoHListenAddr string
+	DoTListenAddr string
+	TLSCertFile   string
+	TLSKeyFile    string
 }
 
 var (
-	config      *Config
-	queryCache  *QueryCache
-	blocklist   *Blocklist
-	numRequests atomic.Uint64
+	config       *Config
+	queryCache   *QueryCache
+	blocklist    *Blocklist
+	allowlist    *Blocklist
+	localRecords *LocalRecords
+	rewrites     *Rewrites
+	forwarders   *Forwarders
+	numRequests  atomic.Uint64
 )
 
 // ParseLogLevel converts a string log level to a slog.Level.
@@ -57,23 +133,82 @@ func Run(initialConfig *Config) {
 
 	mainLog.Info("Starting Veil", "version", config.Version)
 
-	// Setup blocklist.
-	if config.BlocklistFile != "" {
-		var err error
-		blocklist, err = NewBlocklist(config.BlocklistFile, mainLog)
-		blocklist.log.Info("Loading blocklist")
+	if err := validateBlockMode(config.BlockMode, config.BlockAddrs); err != nil {
+		mainLog.Error("Error setting block mode", "err", err)
+		os.Exit(1)
+	}
+
+	// Setup blocklists.
+	blocklists, err := blocklistEntries()
+	if err != nil {
+		mainLog.Error("Error loading blocklists", "err", err)
+		os.Exit(1)
+	}
+
+	if len(blocklists) > 0 {
+		blocklist, err = NewBlocklist(blocklists, mainLog)
 		if err != nil {
 			mainLog.Error("Error loading blocklist", "err", err)
 			os.Exit(1)
 		}
-		blocklist.log.Info("Loading entries into the blocklist", "entries", len(blocklist.list))
+		blocklist.log.Info("Loading entries into the blocklist", "entries", blocklist.Len(), "lists", len(blocklists))
 		config.BlocklistEnabled = true
 	}
 
+	// Setup allowlist.
+	if config.AllowlistFile != "" {
+		var err error
+		allowlist, err = NewAllowlist(config.AllowlistFile, config.AllowlistFormat, mainLog)
+		if err != nil {
+			mainLog.Error("Error loading allowlist", "err", err)
+			os.Exit(1)
+		}
+		allowlist.log.Info("Loading entries into the allowlist", "entries", allowlist.Len())
+		config.AllowlistEnabled = true
+	}
+
+	// Setup local records.
+	if config.LocalRecordsFile != "" {
+		var err error
+		localRecords, err = NewLocalRecords(config.LocalRecordsFile, mainLog)
+		if err != nil {
+			mainLog.Error("Error loading local records", "err", err)
+			os.Exit(1)
+		}
+		localRecords.log.Info("Loading local records", "names", localRecords.Len())
+		config.LocalRecordsEnabled = true
+	}
+
+	// Setup rewrites.
+	if config.RewritesFile != "" || config.SafeSearch {
+		var err error
+		rewrites, err = NewRewrites(config.RewritesFile, config.SafeSearch, mainLog)
+		if err != nil {
+			mainLog.Error("Error loading rewrites", "err", err)
+			os.Exit(1)
+		}
+		rewrites.log.Info("Loading rewrites", "rules", rewrites.Len(), "safe_search", config.SafeSearch)
+		config.RewritesEnabled = true
+	}
+
 	// Setup caching.
 	if config.CachingEnabled {
-		queryCache = NewQueryCache(mainLog)
+		queryCache = NewQueryCache(mainLog, config.CacheMaxEntries, config.CacheMaxBytes, config.StaleWindow)
 		go queryCache.Reaper()
+
+		// Warm the cache from the last snapshot.
+		if config.CacheFile != "" {
+			loaded, err := queryCache.Load(config.CacheFile)
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+				queryCache.log.Info("No cache snapshot to load", "path", config.CacheFile)
+			case err != nil:
+				queryCache.log.Warn("Error loading cache snapshot, starting cold", "err", err, "path", config.CacheFile)
+			default:
+				queryCache.log.Info("Loaded cache snapshot", "entries", loaded, "path", config.CacheFile)
+			}
+			go queryCache.Snapshotter(config.CacheFile)
+		}
 	} else {
 		mainLog.Debug("Caching off")
 	}
@@ -89,7 +224,7 @@ func Run(initialConfig *Config) {
 	}
 
 	// Setup listening for UDP server.
-	mainLog.Info("Adding listener", "host", udpAddr)
+	mainLog.Info("Adding listener", "host", udpAddr, "protocol", "udp")
 	conn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
 		mainLog.Error("Error listening, did you specify one of your IP addresses?", "err", err)
@@ -97,6 +232,15 @@ func Run(initialConfig *Config) {
 	}
 	defer conn.Close()
 
+	// Setup listening for TCP server on the same address.
+	mainLog.Info("Adding listener", "host", udpAddr, "protocol", "tcp")
+	tcpListener, err := net.Listen("tcp", config.ListenAddr)
+	if err != nil {
+		mainLog.Error("Error listening, did you specify one of your IP addresses?", "err", err)
+		os.Exit(1)
+	}
+	defer tcpListener.Close()
+
 	// Load the list of resolvers.
 	resolvers, err := NewResolvers(config.ResolversFile)
 	if err != nil {
@@ -105,62 +249,131 @@ func Run(initialConfig *Config) {
 	}
 
 	// Create the pooler.
-	pool := NewPool(mainLog, len(resolvers.Resolvers))
+	pool := NewPool(mainLog)
 	go pool.ConnectionManagement()
-	go pool.Dispatch()
 
 	// Load each resolver into the pool.
 	for _, resolver := range resolvers.Resolvers {
-		pool.AddResolver(resolver, TLSResolverDialer{})
+		pool.AddResolver(resolver, newResolverDialer(resolver, mainLog))
 	}
 
-	// Enter the listening loop.
-	for {
-		buff := make([]byte, DNSPacketLength)
-		n, clientAddr, _ := conn.ReadFromUDP(buff)
+	// Setup the pools for forwarded domains.
+	forwarders = NewForwarders(mainLog)
+	forwarders.Reconcile(resolvers.Forwarders, func(re ResolverEntry) ResolverDialer {
+		return newResolverDialer(re, mainLog)
+	})
+	forwarders.log.Info("Loading forwarders", "forwarders", forwarders.Len())
+
+	// Setup goroutine for reloading the config on SIGHUP.
+	go reload(pool, mainLog)
 
-		// Potential to catch small packets here.
-		if n < DNSHeaderLength {
-			mainLog.Warn("Packet length too small", "length", n)
-			continue
+	// Load the certificate for serving encrypted clients.
+	var tlsConfig *tls.Config
+	if config.DoHListenAddr != "" || config.DoTListenAddr != "" {
+		tlsConfig, err = newServerTLSConfig(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			mainLog.Error("Error loading TLS certificate", "err", err)
+			os.Exit(1)
 		}
+	}
 
-		request := &Request{
-			clientAddr: clientAddr,
-			clientConn: conn,
-			data:       buff[:n],
-			start:      time.Now()}
+	// Setup the DNS-over-HTTPS server.
+	if config.DoHListenAddr != "" {
+		mainLog.Info("Adding listener", "host", config.DoHListenAddr, "protocol", "https")
+		dohListener, err := net.Listen("tcp", config.DoHListenAddr)
+		if err != nil {
+			mainLog.Error("Error listening for DoH", "err", err)
+			os.Exit(1)
+		}
+		defer dohListener.Close()
 
-		numRequests.Add(1)
+		go serveDoH(dohListener, tlsConfig, pool, mainLog)
+	}
 
-		mainLog.Info("Requests", "requests", numRequests.Load(), "context", "stats")
+	// Setup the DNS-over-TLS server.
+	if config.DoTListenAddr != "" {
+		mainLog.Info("Adding listener", "host", config.DoTListenAddr, "protocol", "tls")
+		dotListener, err := tls.Listen("tcp", config.DoTListenAddr, tlsConfig)
+		if err != nil {
+			mainLog.Error("Error listening for DoT", "err", err)
+			os.Exit(1)
+		}
+		defer dotListener.Close()
 
-		// Spin up new goroutine per request.
-		go resolve(pool, request, mainLog)
+		go serveTCP(dotListener, dotIdleTimeout, pool, mainLog)
 	}
+
+	// Enter the listening loops.
+	go serveTCP(tcpListener, tcpIdleTimeout, pool, mainLog)
+	serveUDP(conn, pool, mainLog)
 }
 
 // resolve handles individual requests.
 func resolve(p *Pool, request *Request, mainLog *slog.Logger) {
 
+	// Check the message is well formed before looking at the question.
+	if msg, err := parseMessage(request.data); err != nil || msg.questionEnd == DNSHeaderLength {
+		mainLog.Warn("Malformed request", "err", err)
+		request.write(newResponse(request.data, rcodeFormErr))
+		return
+	}
+
 	rr, err := NewRR(request.data[DNSHeaderLength:])
 	if err != nil {
 		mainLog.Warn("Problem handling RR", "err", err)
+		request.write(newResponse(request.data, rcodeFormErr))
+		return
+	}
+
+	// Handle the client's OPT record, if any.
+	// SEE: https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.1
+	request.edns, err = parseEDNS(request.data)
+	if err != nil {
+		mainLog.Warn("Problem handling OPT record", "err", err)
+		request.write(newResponse(request.data, rcodeFormErr))
+		return
+	}
+
+	// We only support EDNS version 0.
+	// SEE: https://datatracker.ietf.org/doc/html/rfc6891#section-6.1.3
+	if request.edns != nil && request.edns.version > 0 {
+		mainLog.Warn("Unsupported EDNS version", "version", request.edns.version)
+		response := setEDNS(newResponse(request.data, rcodeSuccess), &EDNS{extRCode: rcodeBadVers >> 4})
+		request.write(response)
 		return
 	}
 	mainLog.Info("New request", "host", rr.hostname, "rtype", rr.rType)
 
+	// Answer local names directly.
+	if config.LocalRecordsEnabled {
+		if response, ok := localRecords.Answer(request.data, rr.hostname); ok {
+			localRecords.log.Info("Answered from local records", "host", rr.hostname, "rtype", rr.rType)
+			request.write(response)
+			return
+		}
+	}
+
 	// Handle blocklisted domains if enabled.
 	// SEE: https://en.wikipedia.org/wiki/DNS_sinkhole
-	if config.BlocklistEnabled && blocklist.Exists(rr.hostname) {
-		blocklist.log.Info("Blocklist match", "host", rr.hostname)
-		// Reform the query as a response with 0 answers.
-		transIDFlags := append(request.data[:2], []byte{0x81, 0x83}...)
-		newPacket := append(transIDFlags, request.data[len(transIDFlags):]...)
-		request.clientConn.WriteToUDP(newPacket, request.clientAddr)
+	if blocked(rr.hostname) {
+		request.write(blockResponse(request.data))
 		return
 	}
 
+	// Answer rewritten names with the records of their target.
+	if config.RewritesEnabled && !request.rewritten {
+		if rule, ok := rewrites.Match(rr.hostname); ok {
+			rewrites.log.Info("Rewriting request", "host", rr.hostname, "rule", rule.From, "target", rule.To)
+			go resolveRewrite(p, request, rule, mainLog)
+			return
+		}
+	}
+
+	// Send forwarded domains to their own resolvers.
+	if forwarders != nil {
+		p = forwarders.Route(rr.hostname, p)
+	}
+
 	// Handle caching if enabled.
 	if config.CachingEnabled {
 		// Create cache key.
@@ -169,26 +382,224 @@ func resolve(p *Pool, request *Request, mainLog *slog.Logger) {
 		// Get the cached entry if we have one.
 		if query, ok := queryCache.Get(cacheKey); ok {
 			queryCache.log.Debug("Cache hit", "entry", cacheKey, "host", rr.hostname, "rtype", rr.rType)
-			// TODO: Check that this lock actually works as expected.
-			// Then maybe move the logic into query cache?
-			queryCache.mu.Lock()
 			// Prepend the transaction id to the payload.
-			responsePacket := append(request.data[:2], query.data[2:]...)
-			queryCache.mu.Unlock()
-			request.clientConn.WriteToUDP(responsePacket, request.clientAddr)
+			responsePacket := slices.Concat(request.data[:2], query.data[2:])
+			request.write(responsePacket)
+
+			// Refresh popular entries before they expire.
+			if queryCache.Prefetch(cacheKey) {
+				queryCache.log.Debug("Prefetching cache entry", "entry", cacheKey, "host", rr.hostname, "rtype", rr.rType)
+				p.enqueue(newBackgroundRequest(request))
+			}
 			return
 		}
+
+		// If there are no upstreams to ask, serve stale and refresh once they're back.
+		if p.liveCount() == 0 && serveStale(request) {
+			request = newBackgroundRequest(request)
+		} else if config.StaleAnswerTimeout > 0 && !request.background {
+			// Don't keep the client waiting on a slow upstream if there's a stale
+			// answer, the request carries on to refresh the cache.
+			// SEE: https://datatracker.ietf.org/doc/html/rfc8767#section-5
+			time.AfterFunc(config.StaleAnswerTimeout, func() { serveStale(request) })
+		}
 	}
 
 	// Otherwise, send it on.
-	select {
-	case p.requests <- request:
-		p.log.Debug("Request added to pool", "context", "pool")
-	default:
-		p.log.Debug("Dropping oldest request", "context", "pool")
-		<-p.requests
-		p.requests <- request
+	p.enqueue(request)
+}
+
+// blocked reports whether host is on the blocklist, logging the rule which
+// blocked or allowed it. Entries on the allowlist are never blocked.
+func blocked(host string) bool {
+	if config.AllowlistEnabled {
+		if rule, _, ok := allowlist.Match(host); ok {
+			allowlist.log.Info("Allowlist match", "host", host, "rule", rule)
+			return false
+		}
 	}
+
+	if config.BlocklistEnabled {
+		if rule, lists, ok := blocklist.Match(host); ok {
+			labels := make([]string, len(lists))
+			names := make([]string, len(lists))
+			for i, list := range lists {
+				labels[i], names[i] = list.label(), list.Name
+			}
+
+			msg := fmt.Sprintf("Blocked by %s list", strings.Join(labels, ", "))
+			if len(lists) > 1 {
+				msg += "s"
+			}
+
+			blocklist.log.Info(msg, "host", host, "rule", rule, "lists", names)
+			return true
+		}
+	}
+
+	return false
+}
+
+// blocklistEntries returns the blocklists to load, those in the blocklists
+// file followed by the single blocklist file.
+func blocklistEntries() ([]BlocklistEntry, error) {
+	var entries []BlocklistEntry
+
+	if config.BlocklistsFile != "" {
+		blocklists, err := NewBlocklists(config.BlocklistsFile)
+		if err != nil {
+			return nil, err
+		}
+		entries = blocklists.Blocklists
+	}
+
+	if config.BlocklistFile != "" {
+		entries = append(entries, BlocklistEntry{Path: config.BlocklistFile, Format: config.BlocklistFormat})
+		if err := validateBlocklists(entries); err != nil {
+			return nil, errors.Join(ErrInvalidBlocklist, err)
+		}
+	}
+
+	return entries, nil
+}
+
+// serveStale answers a request from an expired cache entry, if one is within
+// the stale window. Returns false if there's nothing to serve or the request
+// has already been answered.
+// SEE: https://datatracker.ietf.org/doc/html/rfc8767
+func serveStale(request *Request) bool {
+	if !config.CachingEnabled || request.background || request.answered.Load() {
+		return false
+	}
+
+	rr, err := NewRR(request.data[DNSHeaderLength:])
+	if err != nil {
+		return false
+	}
+
+	cacheKey := createCacheKey(rr.cacheKey)
+
+	query, ok := queryCache.GetStale(cacheKey)
+	if !ok {
+		return false
+	}
+
+	queryCache.log.Info("Serving stale response", "entry", cacheKey, "host", rr.hostname, "rtype", rr.rType)
+
+	request.write(slices.Concat(request.data[:2], query.data[2:]))
+	return true
+}
+
+// serveStaleAndRefresh answers a request which failed upstream from an expired
+// cache entry, if there is one, and queues a background request on p to try
+// refreshing the entry again.
+func serveStaleAndRefresh(p *Pool, request *Request) bool {
+	if !serveStale(request) {
+		return false
+	}
+
+	if p != nil {
+		p.enqueue(newBackgroundRequest(request))
+	}
+	return true
+}
+
+// reload re-reads the blocklists, local records, rewrites and resolvers when
+// sent SIGHUP.
+func reload(p *Pool, mainLog *slog.Logger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		mainLog.Info("Reloading...")
+		if err := reloadConfig(p, mainLog); err != nil {
+			mainLog.Error("Error reloading, keeping the current config", "err", err)
+		}
+	}
+}
+
+// reloadConfig swaps in the blocklists, local records and rewrites and
+// reconciles the pool and forwarders with the resolvers file. Every file is parsed before
+// anything is changed so an invalid file leaves everything as it was.
+func reloadConfig(p *Pool, mainLog *slog.Logger) error {
+	var newBlocklist, newAllowlist *Blocklist
+
+	if config.BlocklistEnabled {
+		entries, err := blocklistEntries()
+		if err != nil {
+			return err
+		}
+
+		if newBlocklist, err = NewBlocklist(entries, mainLog); err != nil {
+			return err
+		}
+	}
+
+	if config.AllowlistEnabled {
+		var err error
+		if newAllowlist, err = NewAllowlist(config.AllowlistFile, config.AllowlistFormat, mainLog); err != nil {
+			return err
+		}
+	}
+
+	var newLocalRecords *LocalRecords
+	if config.LocalRecordsEnabled {
+		var err error
+		if newLocalRecords, err = NewLocalRecords(config.LocalRecordsFile, mainLog); err != nil {
+			return err
+		}
+	}
+
+	var newRewrites *Rewrites
+	if config.RewritesEnabled {
+		var err error
+		if newRewrites, err = NewRewrites(config.RewritesFile, config.SafeSearch, mainLog); err != nil {
+			return err
+		}
+	}
+
+	resolvers, err := NewResolvers(config.ResolversFile)
+	if err != nil {
+		return err
+	}
+
+	if len(resolvers.Resolvers) == 0 {
+		return ErrNoResolvers
+	}
+
+	if newBlocklist != nil {
+		blocklist.replace(newBlocklist)
+		blocklist.log.Info("Reloaded blocklist", "entries", blocklist.Len())
+	}
+
+	if newAllowlist != nil {
+		allowlist.replace(newAllowlist)
+		allowlist.log.Info("Reloaded allowlist", "entries", allowlist.Len())
+	}
+
+	if newLocalRecords != nil {
+		localRecords.replace(newLocalRecords)
+		localRecords.log.Info("Reloaded local records", "names", localRecords.Len())
+	}
+
+	if newRewrites != nil {
+		rewrites.replace(newRewrites)
+		rewrites.log.Info("Reloaded rewrites", "rules", rewrites.Len())
+	}
+
+	newDialer := func(re ResolverEntry) ResolverDialer {
+		return newResolverDialer(re, mainLog)
+	}
+
+	added, removed, kept := p.Reconcile(resolvers.Resolvers, newDialer)
+	p.log.Info("Reloaded resolvers", "added", added, "removed", removed, "kept", kept)
+
+	if forwarders != nil {
+		forwarders.Reconcile(resolvers.Forwarders, newDialer)
+		forwarders.log.Info("Reloaded forwarders", "forwarders", forwarders.Len())
+	}
+
+	return nil
 }
 
 // cleanup handles the exiting of veil.
@@ -200,5 +611,15 @@ func cleanup(mainLog *slog.Logger) {
 	mainLog.Info("Exiting...")
 	mainLog.Info("Total requests served", "total", numRequests.Load(), "context", "stats")
 
+	if config.BlocklistEnabled {
+		blocklist.Stats()
+	}
+
+	if config.CachingEnabled && config.CacheFile != "" {
+		if err := queryCache.Save(config.CacheFile); err != nil {
+			mainLog.Error("Error saving cache snapshot", "err", err)
+		}
+	}
+
 	os.Exit(0)
 }
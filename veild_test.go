@@ -1,7 +1,12 @@
 package veild
 
 import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
+	"time"
 )
 
 func TestVeild_resolve(t *testing.T) {
@@ -21,11 +26,153 @@ func TestVeild_resolve(t *testing.T) {
 		},
 	}
 
-	numResolvers := 2
 	logger := newLogger()
-	pool := NewPool(logger, numResolvers)
+	pool := NewPool(logger)
 
 	resolve(pool, request, logger)
 
 	<-pool.requests
 }
+
+func TestVeild_resolve_unknownType(t *testing.T) {
+	config = &Config{}
+
+	// NAPTR isn't one of the named types but still goes upstream.
+	request := &Request{data: newTestQuery("protonmail.com", 35)}
+
+	logger := newLogger()
+	pool := NewPool(logger)
+
+	resolve(pool, request, logger)
+
+	select {
+	case got := <-pool.requests:
+		if got != request {
+			t.Error("unexpected request")
+		}
+	default:
+		t.Error("expected request to be sent upstream")
+	}
+}
+
+func TestVeild_blocked(t *testing.T) {
+	dir := t.TempDir()
+	blocklistPath := filepath.Join(dir, "blocklist.txt")
+	allowlistPath := filepath.Join(dir, "allowlist.txt")
+	os.WriteFile(blocklistPath, []byte("doubleclick.net\n"), 0o600)
+	os.WriteFile(allowlistPath, []byte("safe.doubleclick.net\n"), 0o600)
+
+	var err error
+	config = &Config{BlocklistEnabled: true, AllowlistEnabled: true}
+	if blocklist, err = NewBlocklist([]BlocklistEntry{{Name: "test", Path: blocklistPath}}, newLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if allowlist, err = NewAllowlist(allowlistPath, formatAuto, newLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"doubleclick.net", true},
+		{"ad.doubleclick.net", true},
+		{"safe.doubleclick.net", false},
+		{"cdn.safe.doubleclick.net", false},
+		{"protonmail.com", false},
+	}
+
+	for _, tt := range tests {
+		if got := blocked(tt.host); got != tt.want {
+			t.Errorf("%s: wanted blocked %v got %v", tt.host, tt.want, got)
+		}
+	}
+}
+
+func TestVeild_reloadConfig_invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist.txt")
+	os.WriteFile(path, []byte("example.com\n"), 0o600)
+
+	var err error
+	config = &Config{BlocklistEnabled: true, BlocklistFile: path, ResolversFile: "fixtures/test_invalid_pin_resolvers.yml"}
+	if blocklist, err = NewBlocklist([]BlocklistEntry{{Name: "test", Path: path}}, newLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new blocklist is fine but the resolvers aren't.
+	os.WriteFile(path, []byte("doubleclick.net\n"), 0o600)
+
+	if err := reloadConfig(NewPool(newLogger()), newLogger()); err == nil {
+		t.Fatal("expected reload to fail")
+	}
+
+	if !blocklist.Exists("example.com") || blocklist.Exists("doubleclick.net") {
+		t.Error("expected blocklist to be left as it was")
+	}
+}
+
+func TestVeild_resolve_rewrite(t *testing.T) {
+	var err error
+	config = &Config{LocalRecordsEnabled: true, RewritesEnabled: true}
+	if localRecords, err = NewLocalRecords("fixtures/test_records.yml", newLogger()); err != nil {
+		t.Fatal(err)
+	}
+	if rewrites, err = NewRewrites("fixtures/test_rewrites.yml", false, newLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := make(chanConn, 1)
+	request := &Request{
+		clientConn: responses,
+		data:       newTestQuery("storage.home.arpa", typeA),
+		maxSize:    maxMessageLength,
+	}
+
+	logger := newLogger()
+	resolve(NewPool(logger), request, logger)
+
+	// The target is resolved from the local records, following its CNAME.
+	want := []string{"CNAME files.home.arpa", "CNAME nas.home.arpa", "A 192.168.1.10"}
+	if got := answerStrings(t, <-responses); !slices.Equal(got, want) {
+		t.Errorf("wanted answers %v got %v", want, got)
+	}
+}
+
+func TestVeild_resolve_staleAnswer(t *testing.T) {
+	config = &Config{CachingEnabled: true, StaleAnswerTimeout: 10 * time.Millisecond}
+	queryCache = NewQueryCache(newLogger(), 0, 0, time.Hour)
+
+	stale := newCachedQuery("protonmail.com", 60)
+	stale.creation = time.Now().Add(-2 * time.Minute)
+	queryCache.Set(stale)
+
+	logger := newLogger()
+	pool := NewPool(logger)
+	pool.setLive(newTestResolver(), true)
+
+	responses := make(chanConn, 1)
+	request := newRequest()
+	request.clientConn = responses
+
+	resolve(pool, request, logger)
+
+	// Upstream doesn't answer in time so the client gets the stale entry.
+	select {
+	case response := <-responses:
+		if rcode(response) != rcodeSuccess {
+			t.Errorf("wanted stale response got rcode %d", rcode(response))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected stale response while waiting on upstream")
+	}
+
+	// The request carries on upstream to refresh the entry, without answering
+	// the client again.
+	if got := <-pool.requests; got != request {
+		t.Error("expected request to still be sent upstream")
+	}
+
+	if _, err := request.write(stale.data); !errors.Is(err, ErrResponseDropped) {
+		t.Errorf("wanted %v got %v", ErrResponseDropped, err)
+	}
+}